@@ -0,0 +1,162 @@
+package tcpraw
+
+import (
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Dialer contains options for connecting to an address.
+//
+// Sockets and firewall rules are created in the network namespace of the
+// calling thread, and the sockets stay there afterwards. To connect from
+// another namespace, call Dial from a goroutine locked to an OS thread that
+// has entered it with setns.
+type Dialer struct {
+	// KeepTTL leaves the TTL of the system TCP connection untouched, instead
+	// of lowering it so the kernel's own packets die before reaching the
+	// peer. It's meant for tunnel interfaces where the kernel doesn't emit
+	// interfering packets, or where the TTL can't be set.
+	KeepTTL bool
+
+	// Mark sets the SO_MARK firewall mark on the connection's sockets, so
+	// both the system TCP connection and the crafted packets follow the
+	// same policy routing rules. 0 leaves the sockets unmarked.
+	Mark int
+
+	// KeepStream stops draining the inbound stream of the system TCP
+	// connection, so it can be read through TCPConn.SystemConn, e.g. as a
+	// control channel next to the crafted packets. Reading slowly fills the
+	// receive buffer, and the kernel then advertises a zero window to the
+	// peer, which stalls its side of the system connection. Writes on it
+	// don't reach the peer unless KeepTTL is set.
+	KeepStream bool
+
+	// SourceIP binds the connection's sockets to a local address other
+	// than the one the kernel would pick, e.g. a secondary address or a VIP,
+	// so both the system TCP connection and the crafted packets come from
+	// it. It must be configured on the interface routing to the peer. nil
+	// leaves the choice to the kernel.
+	SourceIP net.IP
+
+	// FreeBind sets IP_FREEBIND on the sockets, so SourceIP may be an
+	// address not configured on any interface yet, e.g. a floating VIP
+	// during failover. SourceIP is then used as is, without checking the
+	// route to the peer, and the crafted packets still come from it.
+	FreeBind bool
+
+	// RawOnly skips the system TCP connection, the handshake is crafted as
+	// with SendSYN, from a random ephemeral port, and Dial waits up to 10s
+	// for the SYN-ACK. The reset the kernel would answer it with is dropped
+	// by an iptables rule, so iptables is required. KeepTTL, KeepStream and
+	// AddPeer don't apply.
+	RawOnly bool
+
+	// Mode set to ModeWriteOnly skips the capture, for a process which only
+	// writes while another one reads. The flow can't learn the sequence
+	// numbers then, they must be supplied with ImportFlows, e.g. exported by
+	// the reading process, until which writes are dropped. ModeReadOnly
+	// needs a port to capture on, which Dial doesn't have without a system
+	// TCP connection, use ListenConfig.Mode instead. Neither mode works
+	// with RawOnly, whose handshake both captures and sends.
+	Mode Mode
+
+	// HandshakeTimeout bounds how long Dial and AddPeer wait for the
+	// SYN-ACK of the system TCP connection to be captured, so the flow is
+	// ready and writes aren't dropped once they return. 0 waits up to 1s,
+	// a negative value returns at once. On a path that filters the SYN-ACK
+	// from the capture, every Dial takes the whole timeout and still
+	// succeeds, writes are then dropped until the peer sends; the flow is
+	// listed by TCPConn.Peers once ready.
+	HandshakeTimeout time.Duration
+
+	// Control, if not nil, is called on the system TCP socket after the
+	// package has set its own options and before it connects, as with
+	// net.Dialer. It also runs for the sockets of AddPeer. It doesn't apply
+	// with RawOnly.
+	Control func(network, address string, c syscall.RawConn) error
+
+	// Logger receives warnings about conditions the connection survives,
+	// nil discards them.
+	Logger *log.Logger
+}
+
+// ListenConfig contains options for listening to an address.
+//
+// As with Dialer, the listener lives in the network namespace of the
+// calling thread, and only the interfaces visible there are captured on.
+type ListenConfig struct {
+	// AllowedHosts restricts the peers a listener accepts packets from.
+	// Each entry is an IP address or a host name; an empty list accepts
+	// packets from any source. On IPv4 handles, the other sources are
+	// dropped in the kernel by a BPF program, for lists of up to 255 IPv4
+	// addresses, see SetBPFFilter. The system
+	// TCP connections accepted from them are closed at once.
+	AllowedHosts []string
+
+	// Interfaces is a glob pattern, as in path.Match, selecting the network
+	// interfaces to capture on by name when listening on an unspecified address,
+	// e.g. "veth*". An empty pattern selects all interfaces of the current
+	// network namespace.
+	Interfaces string
+
+	// KeepTTL leaves the TTL of accepted system TCP connections untouched,
+	// as in Dialer.
+	KeepTTL bool
+
+	// Mark sets the SO_MARK firewall mark on the connection's sockets,
+	// as in Dialer.
+	Mark int
+
+	// KeepStream stops draining the inbound streams of accepted system TCP
+	// connections, as in Dialer.
+	KeepStream bool
+
+	// ReusePort sets SO_REUSEPORT on the listening socket, so several
+	// processes can listen on the same port and share the incoming
+	// connections, e.g. during a zero-downtime restart. SO_REUSEADDR is
+	// always set by the net package, so a restarted server can bind again
+	// while old connections are in TIME_WAIT. Note that the raw handles of
+	// all those listeners capture every packet to the port.
+	ReusePort bool
+
+	// Backlog sets the queue length of pending connections on the listening
+	// socket, 0 keeps the system default. Linux caps it to
+	// net.core.somaxconn.
+	Backlog int
+
+	// MaxAccepted bounds the accepted system TCP connections drained at once,
+	// connections beyond it are closed as soon as accepted, and their peers'
+	// packets are not delivered. 0 means 65536. It doesn't apply with
+	// KeepStream, where the caller reads the connections.
+	MaxAccepted int
+
+	// FreeBind sets IP_FREEBIND on the listening socket and the raw handle,
+	// so the address may be one not configured on any interface yet, e.g. a
+	// floating VIP. It makes no difference to a wildcard address.
+	FreeBind bool
+
+	// RawOnly skips the listening socket, SYNs from peers are answered with
+	// a crafted SYN-ACK, and the kernel's resets from the port are dropped
+	// by an iptables rule, as in Dialer. The address must have a port, which
+	// is then not reserved by any socket.
+	RawOnly bool
+
+	// Mode set to ModeReadOnly skips the listening socket and the iptables
+	// rules, and captures the packets to the port of the address, e.g. of a
+	// connection dialed or listened on by another process, which sends in
+	// ModeWriteOnly. Writes then fail. The flows learn their sequence
+	// numbers from the peers' segments, ExportFlows hands them to the writing
+	// process. ModeWriteOnly is as in Dialer.
+	Mode Mode
+
+	// Control, if not nil, is called on the listening socket after the
+	// package has set its own options and before it binds, as with
+	// net.ListenConfig. It doesn't apply with RawOnly.
+	Control func(network, address string, c syscall.RawConn) error
+
+	// Logger receives warnings about conditions the connection survives,
+	// nil discards them.
+	Logger *log.Logger
+}
@@ -0,0 +1,6 @@
+package tcpraw
+
+import "errors"
+
+// ErrClosed is returned by the I/O methods of a connection after Close.
+var ErrClosed = errors.New("use of closed connection")
@@ -0,0 +1,20 @@
+package tcpraw
+
+// TCPFlags is a set of TCP header flags carried by crafted segments.
+type TCPFlags uint16
+
+// TCP header flags
+const (
+	FlagFIN TCPFlags = 1 << iota
+	FlagSYN
+	FlagRST
+	FlagPSH
+	FlagACK
+	FlagURG
+	FlagECE
+	FlagCWR
+	FlagNS
+)
+
+// defaultFlags are the flags carried by data segments unless configured otherwise
+const defaultFlags = FlagPSH | FlagACK
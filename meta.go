@@ -0,0 +1,21 @@
+package tcpraw
+
+import "net"
+
+// PacketMeta describes the TCP segment that delivered a packet.
+type PacketMeta struct {
+	Flags       TCPFlags // flags of the segment
+	Window      uint16   // window advertised by the peer
+	WindowScale uint8    // window scale shift of the peer, the window is Window<<WindowScale bytes
+	Seq         uint32   // sequence number of the segment
+	TTL         uint8    // TTL or IPv6 hop limit of the packet, hinting at the peer's distance
+}
+
+// ICMPEvent describes an ICMP or ICMPv6 error message quoting a segment of a flow.
+type ICMPEvent struct {
+	Addr net.Addr // remote address of the flow
+	From net.IP   // source of the message, the peer or a router on the path
+	Type uint8    // ICMP type, destination unreachable or packet too big on ICMPv6
+	Code uint8    // ICMP code, e.g. port unreachable or fragmentation needed
+	MTU  int      // next-hop MTU for fragmentation needed and packet too big, or 0
+}
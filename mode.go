@@ -0,0 +1,12 @@
+package tcpraw
+
+// Mode selects the halves of a connection that are set up, so that capture and
+// injection can run in separate processes, see Dialer.Mode.
+type Mode int
+
+// Modes
+const (
+	ModeReadWrite Mode = iota // capture and send, the default
+	ModeReadOnly              // capture only, without a system TCP socket
+	ModeWriteOnly             // send only, without capturing
+)
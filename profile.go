@@ -0,0 +1,12 @@
+package tcpraw
+
+// OSProfile names the TCP/IP stack of an OS whose header fields crafted segments
+// mimic, see TCPConn.SetOSProfile.
+type OSProfile string
+
+// OS profiles
+const (
+	OSProfileNone      OSProfile = ""          // random windows, minimal SYN options, the kernel's TTL
+	OSProfileLinux     OSProfile = "linux"     // Linux 4.x and later
+	OSProfileWindows10 OSProfile = "windows10" // Windows 10 and 11
+)
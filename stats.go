@@ -0,0 +1,20 @@
+package tcpraw
+
+// CaptureStats holds the packet counters of the capture handles, summed over
+// all handles of a connection.
+type CaptureStats struct {
+	Received   uint64 // packets read from the handles
+	Dropped    uint64 // packets dropped by the kernel because the receive buffers were full
+	Malformed  uint64 // packets skipped because they failed to decode
+	Overflowed uint64 // packets dropped because the queue of their flow was full, see SetFlowQueueLimit
+}
+
+// Throughput holds the payload bytes carried by crafted and captured segments,
+// of a connection or of a flow, and their rates in bytes per second averaged
+// over the last 5 complete seconds.
+type Throughput struct {
+	Sent     uint64  // payload bytes sent
+	Received uint64  // payload bytes delivered to the readers, without copies
+	SendRate float64 // bytes per second sent
+	RecvRate float64 // bytes per second delivered
+}
@@ -3,567 +3,3819 @@
 package tcpraw
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"math"
+	mrand "math/rand"
 	"net"
+	"os"
+	"path"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
 )
 
 var (
 	errOpNotImplemented = errors.New("operation not implemented")
-	errTimeout          = errors.New("timeout")
+	errTimeout          = timeoutError{}
+	errNoAddress        = errors.New("no address to listen on")
+	errNoInterface      = errors.New("no interface matches the pattern")
+	errConcurrency      = errors.New("capture concurrency must be at least 1")
+	errNoHandle         = errors.New("no handle to reach the address")
+	errWriteConcurrency = errors.New("write concurrency must be at least 1")
+	errMSS              = errors.New("MSS out of range")
+	errConnReset        = errors.New("connection reset by peer")
+	errWindowScale      = errors.New("window scale out of range")
+	errNotDialed        = errors.New("connection is not dialed")
+	errWatermarks       = errors.New("queue watermarks must satisfy 0 <= low < high")
+	errQueueFull        = errors.New("queue of the flow is full")
+	errConnRefused      = errors.New("connection refused")
+	errPortRequired     = errors.New("listening without a socket requires a port")
+	errSourceIP         = errors.New("source IP is not configured on the egress interface")
+	errFlowQueueLimit   = errors.New("flow queue limit must not be negative")
+	errOSProfile        = errors.New("unknown OS profile")
+	errWriteSize        = errors.New("payload exceeds the maximum write size")
+	errPort             = errors.New("port out of range")
+	errMode             = errors.New("read-only mode requires Listen, and no mode but read-write works with RawOnly")
+	errReadOnly         = errors.New("connection is read-only")
+	errWriteOnly        = errors.New("connection is write-only")
 	expire              = time.Minute
 )
 
+// timeoutError is returned by I/O past a deadline, it implements net.Error
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// getsockopt SO_MEMINFO on linux, reporting socket drops since 4.6
+const (
+	soMeminfo      = 55
+	skMeminfoDrops = 8
+	skMeminfoVars  = 9
+)
+
+// setsockopt SO_REUSEPORT on linux, missing from package syscall
+const soReuseport = 15
+
+// setsockopt SO_ATTACH_BPF on linux since 3.19, missing from package syscall
+const soAttachBPF = 50
+
+// setsockopt IPV6_FREEBIND on linux since 4.15, missing from package syscall
+const ipv6Freebind = 78
+
+// maxRTTSamples bounds the unacknowledged segments timed per flow
+const maxRTTSamples = 64
+
+// small writes are coalesced until they reach coalesceSize bytes, or for coalesceDelay
+const (
+	coalesceSize  = 1200
+	coalesceDelay = 10 * time.Millisecond
+)
+
+// retransmission in reliable mode, the RTO is twice the smoothed RTT, at least minRTO,
+// or initialRTO before the RTT is known, doubled on each retry of a segment
+const (
+	minRTO         = 200 * time.Millisecond
+	initialRTO     = time.Second
+	maxRetransmits = 8
+	maxUnacked     = 4096 // segments kept per flow, later ones aren't retransmitted
+	retransmitTick = 50 * time.Millisecond
+)
+
+// rawDialTimeout bounds the wait for the SYN-ACK of a raw-only Dial
+const rawDialTimeout = 10 * time.Second
+
+// handshakeCaptureTimeout bounds the wait of Dial and AddPeer for the capture of the
+// handshake, unless set by Dialer.HandshakeTimeout
+const handshakeCaptureTimeout = time.Second
+
+// maxQueued bounds the payloads queued per flow until it's ready, see SetQueueUntilReady
+const maxQueued = 64
+
+// defaultDecodeOptions decode captured packets in place, the payload is copied on delivery
+var defaultDecodeOptions = gopacket.DecodeOptions{NoCopy: true, Lazy: true}
+
+// defaultWindowScale is the window scale shift advertised on crafted SYNs
+const defaultWindowScale = 7
+
+// defaultWriteConcurrency is high enough to leave writers effectively unbounded
+const defaultWriteConcurrency = 65536
+
+// osProfile holds the header fields of an OSProfile
+type osProfile struct {
+	ttl        int                    // TTL and hop limit of crafted packets
+	window     uint16                 // window advertised before scaling
+	wscale     uint8                  // window scale shift advertised on SYNs
+	synOptions []layers.TCPOptionKind // options of SYNs and SYN-ACKs, in order
+	tsHz       int                    // timestamp clock rate, 0 without timestamps
+}
+
+var osProfiles = map[OSProfile]*osProfile{
+	OSProfileLinux: {
+		ttl:    64,
+		window: 64240,
+		wscale: 7,
+		synOptions: []layers.TCPOptionKind{layers.TCPOptionKindMSS, layers.TCPOptionKindSACKPermitted,
+			layers.TCPOptionKindTimestamps, layers.TCPOptionKindNop, layers.TCPOptionKindWindowScale},
+		tsHz: 1000,
+	},
+	OSProfileWindows10: {
+		ttl:    128,
+		window: 64240,
+		wscale: 8,
+		synOptions: []layers.TCPOptionKind{layers.TCPOptionKindMSS, layers.TCPOptionKindNop, layers.TCPOptionKindWindowScale,
+			layers.TCPOptionKindNop, layers.TCPOptionKindNop, layers.TCPOptionKindSACKPermitted},
+	},
+}
+
+// defaultMaxAccepted bounds the accepted connections a listener drains at once
+const defaultMaxAccepted = 65536
+
 // a message from NIC
 type message struct {
-	bts  []byte
-	addr net.Addr
+	bts    []byte
+	addr   net.Addr
+	meta   PacketMeta
+	packet gopacket.Packet // the decoded segment, with SetKeepPackets
+}
+
+// a segment kept for retransmission in reliable mode
+type segment struct {
+	seq     uint32    // sequence number of the first byte
+	data    []byte    // payload
+	flags   TCPFlags  // flags of the segment
+	sent    time.Time // time of the last transmission
+	retries int       // number of retransmissions
+}
+
+// seqRange is the sequence space of a delivered segment
+type seqRange struct {
+	seq uint32
+	n   uint32
+}
+
+// recentSegments is the number of delivered segments remembered per flow, to drop the
+// copies captured on another handle
+const recentSegments = 8
+
+// rateWindow is the number of complete seconds the byte rates are averaged over
+const rateWindow = 5
+
+// rateMeter counts bytes, and the bytes of each of the last seconds, in a ring
+type rateMeter struct {
+	total uint64
+	bytes [rateWindow + 1]uint64
+	secs  [rateWindow + 1]int64
+}
+
+// add counts n bytes at now
+func (m *rateMeter) add(n int, now time.Time) {
+	sec := now.Unix()
+	k := sec % int64(len(m.secs))
+	if m.secs[k] != sec {
+		m.secs[k] = sec
+		m.bytes[k] = 0
+	}
+	m.bytes[k] += uint64(n)
+	m.total += uint64(n)
+}
+
+// rate returns the bytes per second over the rateWindow seconds before the current one
+func (m *rateMeter) rate(now time.Time) float64 {
+	sec := now.Unix()
+	var sum uint64
+	for k := range m.secs {
+		if m.secs[k] < sec && m.secs[k] >= sec-rateWindow {
+			sum += m.bytes[k]
+		}
+	}
+	return float64(sum) / rateWindow
+}
+
+// throughput returns the counts of the sent and received meters at now
+func throughput(sent, received *rateMeter, now time.Time) Throughput {
+	return Throughput{
+		Sent:     sent.total,
+		Received: received.total,
+		SendRate: sent.rate(now),
+		RecvRate: received.rate(now),
+	}
+}
+
+// packetHandle is the raw socket a flow is captured from and sent on, a *net.IPConn
+// outside of tests, where TCP segments are written without IP headers, and read
+// behind the IPv4 header on IPv4
+type packetHandle interface {
+	ReadMsgIP(b, oob []byte) (n, oobn, flags int, addr *net.IPAddr, err error)
+	Write(b []byte) (int, error)
+	WriteToIP(b []byte, addr *net.IPAddr) (int, error)
+	LocalAddr() net.Addr
 }
 
 // a tcp flow information of a connection pair
 type tcpFlow struct {
+	addr         net.Addr                   // the remote address of this flow
 	conn         *net.TCPConn               // the related system TCP connection of this flow
-	handle       *net.IPConn                // the handle to send packets
+	handle       packetHandle               // the handle to send packets
 	seq          uint32                     // TCP sequence number
 	ack          uint32                     // TCP acknowledge number
 	networkLayer gopacket.SerializableLayer // network layer header for tx
 	ts           time.Time                  // last packet incoming time
 	buf          gopacket.SerializeBuffer   // a buffer for write
+	writeLock    sync.Mutex                 // orders the sends, held out of flowsLock while sending
 	tcpHeader    layers.TCP
+	raw          bool          // the flow is handshaked by SendSYN rather than a system TCP connection
+	synSent      bool          // a crafted SYN is waiting for the SYN-ACK
+	ready        bool          // the flow is related to a connection and has a handle to send packets
+	probe        chan struct{} // closed when the next packet from the peer arrives
+	peerScale    uint8         // window scale shift from the peer's SYN
+	synced       bool          // ack follows the peer's sequence numbers
+
+	// segments delivered lately, a ring
+	recent    [recentSegments]seqRange
+	recentPos int
+
+	// payload bytes sent and delivered, see FlowThroughput
+	sentBytes     rateMeter
+	receivedBytes rateMeter
+
+	// TCP timestamps with an OS profile
+	tsRecent uint32 // last timestamp value of the peer, echoed back
+	peerTS   bool   // the peer sends timestamps
+	tsOffset uint32 // random offset of our timestamp clock
+	tsSet    bool   // tsOffset is chosen
+
+	// round-trip time estimation
+	sent map[uint32]time.Time // send time of unacknowledged segments, keyed by their ending sequence number
+	srtt time.Duration        // smoothed round-trip time
+
+	// duplicate ack detection
+	peerAck   uint32 // last ack from the peer
+	peerAcked bool   // peerAck is valid
+	dupAcks   int    // consecutive duplicates of peerAck
+
+	// reliable mode
+	unacked []segment // sent segments waiting for an ack, in sequence order
+
+	// payloads written before the flow had a handle, see SetQueueUntilReady
+	queued []segment
+
+	// data captured on a listener after the peer's SYN, before the system TCP
+	// connection is accepted, delivered once it is
+	synSeen bool
+	early   []message
+
+	// delayed acks
+	ackPending int         // data segments received since the last segment sent
+	ackTimer   *time.Timer // timer to send a pure ack for them
+
+	// write coalescing
+	pending    []byte      // buffered payload not sent yet
+	flushTimer *time.Timer // timer to send the buffered payload
+	flushErr   error       // error of the last flush by flushTimer, returned by the next write
+}
+
+// flowBucket is the token bucket of a source creating flows
+type flowBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// exportedFlow is the state of a flow serialized by ExportFlows
+type exportedFlow struct {
+	Addr      string
+	Seq       uint32
+	Ack       uint32
+	PeerScale uint8
 }
 
 // TCPConn defines a TCP-packet oriented connection
 type TCPConn struct {
 	die     chan struct{}
 	dieOnce sync.Once
+	readers sync.WaitGroup // capture goroutines, see Wait
 
 	// the main golang sockets
-	tcpconn  *net.TCPConn     // from net.Dial
-	listener *net.TCPListener // from net.Listen
+	tcpconn    *net.TCPConn     // from net.Dial
+	network    string           // network of net.Dial
+	mark       int              // SO_MARK of the sockets
+	sourceIP   net.IP           // local address the dialed sockets are bound to
+	control    controlFunc      // caller's hook on the dialed system sockets
+	freeBind   bool             // sockets may bind to an address not configured yet
+	server     bool             // created by Listen
+	rawOnly    bool             // no system TCP connections, handshakes are crafted
+	readOnly   bool             // captures only, nothing is sent, see ModeReadOnly
+	writeOnly  bool             // sends only, nothing is captured, see ModeWriteOnly
+	laddr      *net.TCPAddr     // local address
+	raddr      *net.TCPAddr     // remote address of Dial
+	listener   *net.TCPListener // from net.Listen
+	keepTTL    bool             // don't touch the TTL of the sockets
+	keepStream bool             // leave the system TCP connections to the caller
+	synWait    time.Duration    // wait for the capture of the handshake, see Dialer.HandshakeTimeout
+	logger     *log.Logger      // warnings, nil to discard
 
 	// handles
 	handles []*net.IPConn
 
+	// capture goroutines running on each handle
+	ports          []int  // local port captured on each handle
+	loopback       []bool // whether each handle captures on loopback
+	captureWorkers int32  // number of capture goroutines per handle
+	captureLock    sync.Mutex
+	sendLock       sync.RWMutex  // held for reading by sends, for writing by Close
+	received       uint64        // packets read from the handles
+	malformed      uint64        // packets that failed to decode
+	overflowed     uint64        // packets dropped from full flow queues
+	icmpHandles    []*net.IPConn // capture ICMP errors for SetOnICMP
+
 	// packets captured from all related NICs will be delivered to this channel
 	chMessage chan message
 
+	// read queue in front of chMessage when watermarks are set, capture pauses
+	// once it reaches queueHigh messages, and resumes when it drains to queueLow
+	queue       []message
+	queueLow    int
+	queueHigh   int
+	queuePaused bool
+	queueResume chan struct{} // closed when capture resumes
+	queueSignal chan struct{} // wakes the pump when messages are queued
+	queueLock   sync.Mutex
+
+	// per-flow read queues with SetFlowQueueLimit, drained a message of each flow
+	// in turn, guarded by queueLock
+	flowQueues     map[string][]message
+	flowOrder      []string // flows with queued messages, in drain order
+	flowQueued     int      // messages in flowQueues
+	flowQueueLimit int
+
 	// all TCP flows
 	flowTable map[string]*tcpFlow
+	single    *tcpFlow // flow of the dialed connection, also in flowTable
 	flowsLock sync.Mutex
 
+	// payload bytes sent and delivered by all flows, guarded by flowsLock, see Throughput
+	sentBytes     rateMeter
+	receivedBytes rateMeter
+
+	// source IPs allowed to reach a listener, nil means any, and the BPF prefix
+	// dropping the others on the IPv4 handles, nil if there are too many
+	allowed      map[string]bool
+	allowProgram []bpf.Instruction
+
+	// BPF program attached to the handles, classic or eBPF
+	filter     []bpf.RawInstruction
+	ebpf       int  // fd of the eBPF program if ebpfSet
+	ebpfSet    bool // the eBPF program replaces filter
+	filterLock sync.Mutex
+
 	// iptables
 	iptables *iptables.IPTables
-	iprule   []string
+	iprules  [][]string
 
 	ip6tables *iptables.IPTables
-	ip6rule   []string
+	ip6rules  [][]string
 
 	// deadlines
 	readDeadline  atomic.Value
 	writeDeadline atomic.Value
 
+	// error of a dialed connection the peer has reset, of type error
+	resetErr atomic.Value
+
+	// callbacks
+	onNewFlow    atomic.Value // func(net.Addr)
+	onFlowClosed atomic.Value // func(net.Addr, string)
+	onICMP       atomic.Value // func(ICMPEvent)
+	outboundHook atomic.Value // func([]byte) []byte
+	inboundHook  atomic.Value // func(gopacket.Packet) bool
+
 	// serialization
-	opts gopacket.SerializeOptions
+	opts            gopacket.SerializeOptions // guarded by flowsLock
+	flags           uint32                    // TCPFlags of data segments
+	coalesce        int32                     // non-zero to coalesce small writes
+	mss             int32                     // MSS clamp advertised on SYNs, 0 for none
+	wscale          int32                     // window scale shift advertised on SYNs
+	reliable        int32                     // non-zero to retransmit unacked segments
+	queueUntilReady int32                     // non-zero to queue writes to flows without a handle
+	maxWindow       int32                     // cap of the advertised windows, 0 for 65535
+	dynamicWindow   int32                     // non-zero to shrink the windows with the read backlog
+	keepPackets     int32                     // non-zero to deliver the decoded segments
+	maxWriteSize    int32                     // bytes a write may carry, 0 for no limit
+	portOverride    uint32                    // source<<16|destination ports of SetPorts, 0 for the flow's
+	profile         atomic.Value              // *osProfile of SetOSProfile, nil for none
+
+	retransmitOnce sync.Once
+
+	// options decoding captured packets, of type gopacket.DecodeOptions
+	decodeOpts atomic.Value
+
+	// semaphore bounding the concurrent writers, of type chan struct{}
+	writeSem atomic.Value
+
+	// delayed acks of inbound data, see SetDelayedAck
+	ackCount int32
+	ackDelay int64 // time.Duration
+
+	// retries of sends failing with a transient error
+	writeRetries int32
+	writeBackoff int64 // time.Duration before the first retry, doubled on each
+
+	// token buckets of the sources creating flows, keyed by IP
+	flowRate     int32 // flows per second per source, 0 for unlimited
+	flowBuckets  map[string]*flowBucket
+	flowRateLock sync.Mutex
+
+	// token bucket pacing outbound bytes
+	paceRate   float64 // bytes per second, 0 for unlimited
+	paceTokens float64
+	paceLast   time.Time
+	paceLock   sync.Mutex
+
+	// random source of ISNs and windows, nil for crypto/rand
+	seqRand  *mrand.Rand
+	randLock sync.Mutex
+}
+
+// logf writes a warning to the logger if there is one
+func (conn *TCPConn) logf(format string, v ...interface{}) {
+	if conn.logger != nil {
+		conn.logger.Printf(format, v...)
+	}
 }
 
 // lockflow locks the flow table and apply function `f` to the entry, and create one if not exist
 func (conn *TCPConn) lockflow(addr net.Addr, f func(e *tcpFlow)) {
-	key := addr.String()
 	conn.flowsLock.Lock()
-	e := conn.flowTable[key]
-	if e == nil { // entry first visit
-		e = new(tcpFlow)
-		e.ts = time.Now()
-		e.buf = gopacket.NewSerializeBuffer()
+	// the dialed flow skips formatting the key and the map lookup
+	e := conn.single
+	if e == nil || !sameAddr(e.addr, addr) {
+		key := addr.String()
+		e = conn.flowTable[key]
+		if e == nil { // entry first visit
+			e = new(tcpFlow)
+			e.addr = addr
+			e.ts = time.Now()
+			e.buf = gopacket.NewSerializeBuffer()
+			conn.flowTable[key] = e
+		}
 	}
 	f(e)
-	conn.flowTable[key] = e
 	conn.flowsLock.Unlock()
 }
 
+// sameAddr reports whether a and b are the same TCP address
+func sameAddr(a, b net.Addr) bool {
+	ta, ok := a.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	tb, ok := b.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	return ta.Port == tb.Port && ta.Zone == tb.Zone && ta.IP.Equal(tb.IP)
+}
+
+// deleteflow removes the flow of addr from the flow table if it exists,
+// and reports whether the removed flow was ready
+func (conn *TCPConn) deleteflow(addr net.Addr) (ready bool) {
+	key := addr.String()
+	conn.flowsLock.Lock()
+	if e := conn.flowTable[key]; e != nil {
+		if e.conn == conn.tcpconn { // a dialed connection is closed by Close
+			e.conn = nil
+		}
+		e.close(conn.keepTTL)
+		ready = e.ready
+		delete(conn.flowTable, key)
+		if e == conn.single {
+			conn.single = nil
+		}
+	}
+	conn.flowsLock.Unlock()
+	return
+}
+
+// track follows the sequence numbers of both directions with a segment from the peer
+// received at now. First the start of the peer's data is learned, from a SYN, or from
+// whatever segment is seen first if the handshake was missed, only then does in-order
+// payload advance the ack, so a first segment carrying data is acknowledged in full.
+func (e *tcpFlow) track(tcp *layers.TCP, now time.Time) {
+	if tcp.ACK {
+		// a pure ack repeating the last one is a duplicate, the peer is missing data
+		if e.peerAcked && tcp.Ack == e.peerAck && len(tcp.Payload) == 0 && !tcp.SYN && !tcp.FIN {
+			e.dupAcks++
+		} else if tcp.Ack != e.peerAck {
+			e.dupAcks = 0
+		}
+		e.peerAck = tcp.Ack
+		e.peerAcked = true
+
+		// a stale ack must not rewind seq over segments kept for retransmission
+		if len(e.unacked) == 0 || int32(tcp.Ack-e.seq) > 0 {
+			e.seq = tcp.Ack
+		}
+		e.acked(tcp.Ack, now)
+	}
+
+	if tcp.SYN {
+		e.ack = tcp.Seq + 1
+		e.synced = true
+	} else if !e.synced {
+		e.ack = tcp.Seq
+		e.synced = true
+	}
+
+	if tcp.PSH && e.ack == tcp.Seq {
+		e.ack = tcp.Seq + uint32(len(tcp.Payload))
+	}
+}
+
+// acked updates the smoothed RTT from the segments acknowledged by ack at time now
+func (e *tcpFlow) acked(ack uint32, now time.Time) {
+	for end, ts := range e.sent {
+		if int32(end-ack) <= 0 {
+			sample := now.Sub(ts)
+			if e.srtt == 0 {
+				e.srtt = sample
+			} else {
+				e.srtt += (sample - e.srtt) / 8
+			}
+			delete(e.sent, end)
+		}
+	}
+
+	// drop the retransmission copies of the segments acknowledged in full
+	k := 0
+	for k < len(e.unacked) && int32(e.unacked[k].seq+uint32(len(e.unacked[k].data))-ack) <= 0 {
+		k++
+	}
+	if k > 0 {
+		e.unacked = append(e.unacked[:0], e.unacked[k:]...)
+	}
+}
+
+// rto returns the retransmission timeout of the flow
+func (e *tcpFlow) rto() time.Duration {
+	if e.srtt == 0 {
+		return initialRTO
+	}
+	if rto := 2 * e.srtt; rto > minRTO {
+		return rto
+	}
+	return minRTO
+}
+
+// close releases the system TCP connection related to the flow, restoring its TTL unless keepTTL
+func (e *tcpFlow) close(keepTTL bool) {
+	if e.flushTimer != nil {
+		e.flushTimer.Stop()
+	}
+	if e.ackTimer != nil {
+		e.ackTimer.Stop()
+	}
+	if e.conn != nil {
+		if !keepTTL {
+			setTTL(e.conn, 64) // the connection is closed anyway
+		}
+		e.conn.Close()
+	}
+}
+
 // clean expired flows
 func (conn *TCPConn) cleaner() {
 	ticker := time.NewTicker(time.Minute)
-	select {
-	case <-conn.die:
-		return
-	case <-ticker.C:
-		conn.flowsLock.Lock()
-		for k, v := range conn.flowTable {
-			if time.Now().Sub(v.ts) > expire {
-				if v.conn != nil {
-					setTTL(v.conn, 64)
-					v.conn.Close()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.die:
+			return
+		case <-ticker.C:
+			var expired []net.Addr
+			conn.flowsLock.Lock()
+			for k, v := range conn.flowTable {
+				if time.Now().Sub(v.ts) > expire {
+					v.close(conn.keepTTL)
+					if v.ready {
+						expired = append(expired, v.addr)
+					}
+					delete(conn.flowTable, k)
+					if v == conn.single {
+						conn.single = nil
+					}
 				}
-				delete(conn.flowTable, k)
 			}
+			conn.flowsLock.Unlock()
+
+			for _, addr := range expired {
+				conn.notifyFlowClosed(addr, "idle")
+			}
+			conn.pruneFlowBuckets()
 		}
-		conn.flowsLock.Unlock()
 	}
 }
 
-// captureFlow capture every inbound packets based on rules of BPF
-func (conn *TCPConn) captureFlow(handle *net.IPConn, port int) {
+// notifyFlowClosed invokes the flow closed callback, it must be called without flowsLock
+func (conn *TCPConn) notifyFlowClosed(addr net.Addr, reason string) {
+	if f, ok := conn.onFlowClosed.Load().(func(net.Addr, string)); ok && f != nil {
+		f(addr, reason)
+	}
+}
+
+// captureFlow capture every inbound packets based on rules of BPF,
+// the worker exits once its index is beyond the capture concurrency
+func (conn *TCPConn) captureFlow(handle packetHandle, port int, worker int32) {
+	defer conn.readers.Done()
 	buf := make([]byte, 2048)
-	opt := gopacket.DecodeOptions{NoCopy: true, Lazy: true}
+	oob := make([]byte, syscall.CmsgSpace(4))
+	loopback := isLoopback(handle)
 	for {
-		n, addr, err := handle.ReadFromIP(buf)
+		if worker >= atomic.LoadInt32(&conn.captureWorkers) {
+			return
+		}
+		if !conn.waitQueue() {
+			return
+		}
+
+		n, oobn, _, addr, err := handle.ReadMsgIP(buf, oob)
 		if err != nil {
 			return
 		}
+		atomic.AddUint64(&conn.received, 1)
+		data, ttl := ipPayload(buf[:n], oob[:oobn], addr.IP)
+
+		// a kept packet must not share the capture buffer
+		keep := atomic.LoadInt32(&conn.keepPackets) != 0
+		if keep {
+			data = append([]byte(nil), data...)
+		}
 
 		// try decoding TCP frame from buf[:n]
-		packet := gopacket.NewPacket(buf[:n], layers.LayerTypeTCP, opt)
+		opt, ok := conn.decodeOpts.Load().(gopacket.DecodeOptions)
+		if !ok {
+			opt = defaultDecodeOptions
+		}
+		packet := gopacket.NewPacket(data, layers.LayerTypeTCP, opt)
+		if packet.ErrorLayer() != nil {
+			atomic.AddUint64(&conn.malformed, 1)
+			continue
+		}
+		if hook, ok := conn.inboundHook.Load().(func(gopacket.Packet) bool); ok && hook != nil && !hook(packet) {
+			continue
+		}
 		transport := packet.TransportLayer()
 		tcp, ok := transport.(*layers.TCP)
 		if !ok {
 			continue
 		}
 
-		// port filtering
+		// port filtering, raw sockets only see inbound packets, except on
+		// loopback where our own crafted packets arrive with the peer's port
 		if int(tcp.DstPort) != port {
 			continue
 		}
 
+		// on loopback, a segment sent to our own port is captured again by our handle,
+		// nobody else sends from our address and port, so it's our own
+		if loopback && int(tcp.SrcPort) == port && conn.isLocal(handle, addr.IP) {
+			continue
+		}
+
+		// source filtering
+		if conn.allowed != nil && !conn.allowed[addr.IP.String()] {
+			continue
+		}
+
 		// address building
 		var src net.TCPAddr
 		src.IP = addr.IP
 		src.Port = int(tcp.SrcPort)
 
-		var orphan bool
+		// throttle the sources creating flows too fast
+		if !conn.allowFlow(&src) {
+			continue
+		}
+
+		var orphan, handshake, synAck, ready, duplicate, ackNow, newHandle bool
+		var peerScale uint8
+		var queued []segment
+		reliable := atomic.LoadInt32(&conn.reliable) != 0
+		ackCount := int(atomic.LoadInt32(&conn.ackCount))
+		prof, _ := conn.profile.Load().(*osProfile)
+		tracksTS := prof != nil && prof.tsHz > 0
 		// flow maintaince
 		conn.lockflow(&src, func(e *tcpFlow) {
-			if e.conn == nil { // make sure it's related to net.TCPConn
+			// without a listening socket, SYNs are answered here with a fresh ISN
+			if conn.rawOnly && conn.server && tcp.SYN && !tcp.ACK {
+				e.raw = true
+				e.seq = conn.random32()
+				synAck = true
+			}
+			if e.conn == nil && !e.raw && !conn.readOnly { // make sure it's related to net.TCPConn
 				orphan = true // mark as orphan if it's not related net.TCPConn
 			}
+			if tcp.SYN && !tcp.ACK {
+				e.synSeen = true
+			}
+			// the client may speak first, before the accept loop records the connection
+			early := orphan && conn.server && e.synSeen && tcp.PSH && len(tcp.Payload) > 0 && len(e.early) < maxQueued
 
-			// to keep track of TCP header related to this source
+			// to keep track of TCP header related to this source, in reliable mode
+			// only in-order data is delivered, the rest is retransmitted anyway
 			e.ts = time.Now()
-			if tcp.ACK {
-				e.seq = tcp.Ack
+			if tracksTS {
+				e.trackTimestamp(tcp)
 			}
-			if tcp.SYN {
-				e.ack = tcp.Seq + 1
+			duplicate = reliable && e.synced && tcp.PSH && tcp.Seq != e.ack
+			if !duplicate && (!orphan || early) && tcp.PSH && len(tcp.Payload) > 0 {
+				duplicate = e.delivered(tcp.Seq, uint32(len(tcp.Payload)))
+				if !duplicate {
+					e.receivedBytes.add(len(tcp.Payload), e.ts)
+					conn.receivedBytes.add(len(tcp.Payload), e.ts)
+				}
 			}
-			if tcp.PSH {
-				if e.ack == tcp.Seq {
-					e.ack = tcp.Seq + uint32(len(tcp.Payload))
+			e.track(tcp, e.ts)
+			if tcp.SYN {
+				e.peerScale = windowScale(tcp)
+				if tcp.ACK && e.synSent { // SYN-ACK to a crafted SYN
+					e.synSent = false
+					handshake = true
 				}
 			}
+			newHandle = e.handle == nil
 			e.handle = handle
+			peerScale = e.peerScale
+			queued = e.queued
+			e.queued = nil
+			if e.probe != nil {
+				close(e.probe)
+				e.probe = nil
+			}
+
+			// acknowledge data at once in reliable mode, or once enough of it is
+			// pending or after a delay with delayed acks
+			if !orphan && tcp.PSH && len(tcp.Payload) > 0 {
+				if ackCount > 0 {
+					e.ackPending++
+					if e.ackPending >= ackCount {
+						ackNow = true
+					} else if delay := time.Duration(atomic.LoadInt64(&conn.ackDelay)); delay > 0 && e.ackTimer == nil {
+						e.ackTimer = time.AfterFunc(delay, func() { conn.ackflow(&src) })
+					}
+				} else if reliable {
+					ackNow = true
+				}
+			}
+			if !orphan && !e.ready {
+				e.ready = true
+				ready = true
+			}
+			if early && !duplicate {
+				payload := make([]byte, len(tcp.Payload))
+				copy(payload, tcp.Payload)
+				meta := PacketMeta{Flags: getFlags(tcp), Window: tcp.Window, WindowScale: peerScale, Seq: tcp.Seq, TTL: ttl}
+				e.early = append(e.early, message{payload, &src, meta, kept(keep, packet)})
+			}
 		})
 
+		// a listener replies from the address the peer reached, which the route back may not carry
+		if newHandle && conn.server && !conn.readOnly && !loopback && conn.logger != nil {
+			go conn.checkRoute(handle, src.IP)
+		}
+
+		// answer a SYN in raw-only mode
+		if synAck {
+			conn.output(nil, &src, FlagSYN|FlagACK, 0, nil)
+		}
+
+		// complete the crafted handshake, or acknowledge data
+		if handshake || ackNow {
+			conn.output(nil, &src, FlagACK, 0, nil)
+		}
+
+		// send what was written before the flow could be reached
+		for _, seg := range queued {
+			conn.output(seg.data, &src, seg.flags, 0, nil)
+		}
+
+		// notify the new flow out of the lock
+		if ready {
+			if f, ok := conn.onNewFlow.Load().(func(net.Addr)); ok && f != nil {
+				f(&src)
+			}
+		}
+
 		// push data if it's not orphan
-		if !orphan && tcp.PSH {
+		if !orphan && !duplicate && tcp.PSH {
 			payload := make([]byte, len(tcp.Payload))
 			copy(payload, tcp.Payload)
-			select {
-			case conn.chMessage <- message{payload, &src}:
-			case <-conn.die:
+			meta := PacketMeta{Flags: getFlags(tcp), Window: tcp.Window, WindowScale: peerScale, Seq: tcp.Seq, TTL: ttl}
+			if !conn.deliver(message{payload, &src, meta, kept(keep, packet)}) {
 				return
 			}
 		}
+
+		// the peer is tearing down the flow, a reset dialed connection is unusable
+		if tcp.RST && conn.raddr != nil && sameAddr(&src, conn.raddr) {
+			conn.resetErr.Store(errConnReset)
+		}
+		if tcp.FIN || tcp.RST {
+			if conn.deleteflow(&src) {
+				if tcp.RST {
+					conn.notifyFlowClosed(&src, "rst")
+				} else {
+					conn.notifyFlowClosed(&src, "fin")
+				}
+			}
+		}
 	}
 }
 
-// ReadFrom implements the PacketConn ReadFrom method.
-func (conn *TCPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	var timer *time.Timer
-	var deadline <-chan time.Time
-	if d, ok := conn.readDeadline.Load().(time.Time); ok && !d.IsZero() {
-		timer = time.NewTimer(time.Until(d))
-		defer timer.Stop()
-		deadline = timer.C
+// checkRoute warns if the kernel routes the packets to dst through an interface without
+// the local address of handle, e.g. with asymmetric or source-based routing, as the
+// segments crafted from that address are then likely dropped on the way
+func (conn *TCPConn) checkRoute(handle packetHandle, dst net.IP) {
+	local, ok := handle.LocalAddr().(*net.IPAddr)
+	if !ok || local == nil || local.IP.IsUnspecified() {
+		return
+	}
+	if checkSourceIP(local.IP, dst) == errSourceIP {
+		conn.logf("tcpraw: packets to %v are routed through an interface without %v, the peer may never see the segments sent from it", dst, local.IP)
+	}
+}
+
+// kept returns packet if it's kept for ReadFromPacket
+func kept(keep bool, packet gopacket.Packet) gopacket.Packet {
+	if keep {
+		return packet
+	}
+	return nil
+}
+
+// isLoopback reports whether a handle captures on loopback, where the packets sent
+// are captured as well, from its local address
+func isLoopback(handle packetHandle) bool {
+	local, ok := handle.LocalAddr().(*net.IPAddr)
+	return ok && local != nil && local.IP.IsLoopback()
+}
+
+// isLocal reports whether ip is the local address of handle or of the connection
+func (conn *TCPConn) isLocal(handle packetHandle, ip net.IP) bool {
+	if local, ok := handle.LocalAddr().(*net.IPAddr); ok && local != nil && local.IP.Equal(ip) {
+		return true
+	}
+	return conn.laddr != nil && conn.laddr.IP.Equal(ip)
+}
+
+// deliver hands a captured message to the readers, through the read queues when
+// watermarks or a flow queue limit are set, it returns false once the connection
+// is closed
+func (conn *TCPConn) deliver(msg message) bool {
+	conn.queueLock.Lock()
+	if conn.queueHigh == 0 && conn.flowQueueLimit == 0 && conn.queued() == 0 {
+		conn.queueLock.Unlock()
+		select {
+		case conn.chMessage <- msg:
+			return true
+		case <-conn.die:
+			return false
+		}
+	}
+
+	// keep queueing while the queue drains after the watermarks are cleared
+	if conn.flowQueueLimit > 0 {
+		key := msg.addr.String()
+		q := conn.flowQueues[key]
+		if len(q) >= conn.flowQueueLimit {
+			conn.queueLock.Unlock()
+			atomic.AddUint64(&conn.overflowed, 1)
+			return true
+		}
+		if len(q) == 0 {
+			conn.flowOrder = append(conn.flowOrder, key)
+		}
+		conn.flowQueues[key] = append(q, msg)
+		conn.flowQueued++
+	} else {
+		conn.queue = append(conn.queue, msg)
+	}
+	if conn.queueHigh > 0 && !conn.queuePaused && conn.queued() >= conn.queueHigh {
+		conn.queuePaused = true
+		conn.queueResume = make(chan struct{})
 	}
+	signal := conn.queueSignal
+	conn.queueLock.Unlock()
 
 	select {
-	case <-deadline:
-		return 0, nil, errTimeout
-	case <-conn.die:
-		return 0, nil, io.EOF
-	case packet := <-conn.chMessage:
-		n = copy(p, packet.bts)
-		return n, packet.addr, nil
+	case signal <- struct{}{}:
+	default:
 	}
+	return true
 }
 
-// WriteTo implements the PacketConn WriteTo method.
-func (conn *TCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	var deadline <-chan time.Time
-	if d, ok := conn.writeDeadline.Load().(time.Time); ok && !d.IsZero() {
-		timer := time.NewTimer(time.Until(d))
-		defer timer.Stop()
-		deadline = timer.C
+// waitQueue blocks capture while the read queue is paused, it returns false once
+// the connection is closed
+func (conn *TCPConn) waitQueue() bool {
+	conn.queueLock.Lock()
+	if !conn.queuePaused {
+		conn.queueLock.Unlock()
+		return true
 	}
+	resume := conn.queueResume
+	conn.queueLock.Unlock()
 
 	select {
-	case <-deadline:
-		return 0, errTimeout
+	case <-resume:
+		return true
 	case <-conn.die:
-		return 0, io.EOF
-	default:
-		raddr, err := net.ResolveTCPAddr("tcp", addr.String())
-		if err != nil {
-			return 0, err
-		}
+		return false
+	}
+}
 
-		var lport int
-		if conn.tcpconn != nil {
-			lport = conn.tcpconn.LocalAddr().(*net.TCPAddr).Port
-		} else {
-			lport = conn.listener.Addr().(*net.TCPAddr).Port
-		}
+// resumeQueue resumes capture if the queue is paused and has drained to queueLow,
+// it must be called with queueLock held
+func (conn *TCPConn) resumeQueue() {
+	if conn.queuePaused && conn.queued() <= conn.queueLow {
+		conn.queuePaused = false
+		close(conn.queueResume)
+	}
+}
 
-		conn.lockflow(addr, func(e *tcpFlow) {
-			// if the flow doesn't have handle , assume this packet has lost, without notification
-			if e.handle == nil {
-				n = len(p)
-				return
-			}
+// queued returns the number of messages in the read queues, it must be called
+// with queueLock held
+func (conn *TCPConn) queued() int {
+	return len(conn.queue) + conn.flowQueued
+}
 
-			// build tcp header with local and remote port
-			e.tcpHeader.SrcPort = layers.TCPPort(lport)
-			e.tcpHeader.DstPort = layers.TCPPort(raddr.Port)
-			binary.Read(rand.Reader, binary.LittleEndian, &e.tcpHeader.Window)
-			e.tcpHeader.Window |= 0x8000 // make sure it's larger than 32768
-			e.tcpHeader.Ack = e.ack
-			e.tcpHeader.Seq = e.seq
-			e.tcpHeader.PSH = true
-			e.tcpHeader.ACK = true
+// startPump starts moving the read queues to the readers, once, it must be called
+// with queueLock held
+func (conn *TCPConn) startPump() {
+	if conn.queueSignal == nil {
+		conn.queueSignal = make(chan struct{}, 1)
+		go conn.pump()
+	}
+}
 
-			// build IP header with src & dst ip for TCP checksum
-			if raddr.IP.To4() != nil {
-				ip := &layers.IPv4{
-					Protocol: layers.IPProtocolTCP,
-					SrcIP:    e.handle.LocalAddr().(*net.IPAddr).IP.To4(),
-					DstIP:    raddr.IP.To4(),
-				}
-				e.tcpHeader.SetNetworkLayerForChecksum(ip)
-			} else {
-				ip := &layers.IPv6{
-					NextHeader: layers.IPProtocolTCP,
-					SrcIP:      e.handle.LocalAddr().(*net.IPAddr).IP.To16(),
-					DstIP:      raddr.IP.To16(),
-				}
-				e.tcpHeader.SetNetworkLayerForChecksum(ip)
+// pump moves the messages of the read queues to the readers, in order, or a
+// message of each flow in turn from the flow queues, which go first as they
+// hold the older messages after the flow queue limit is removed
+func (conn *TCPConn) pump() {
+	for {
+		conn.queueLock.Lock()
+		if conn.queued() == 0 {
+			conn.queueLock.Unlock()
+			select {
+			case <-conn.queueSignal:
+				continue
+			case <-conn.die:
+				return
 			}
+		}
+		// the pump is the only one removing messages
+		var key string
+		var msg message
+		if conn.flowQueued > 0 {
+			key = conn.flowOrder[0]
+			msg = conn.flowQueues[key][0]
+		} else {
+			msg = conn.queue[0]
+		}
+		conn.queueLock.Unlock()
 
-			e.buf.Clear()
-			gopacket.SerializeLayers(e.buf, conn.opts, &e.tcpHeader, gopacket.Payload(p))
-			if conn.tcpconn != nil {
-				_, err = e.handle.Write(e.buf.Bytes())
+		select {
+		case conn.chMessage <- msg:
+		case <-conn.die:
+			return
+		}
+
+		conn.queueLock.Lock()
+		if key != "" {
+			q := conn.flowQueues[key]
+			q[0] = message{}
+			conn.flowOrder = conn.flowOrder[1:]
+			if q = q[1:]; len(q) > 0 {
+				conn.flowQueues[key] = q
+				conn.flowOrder = append(conn.flowOrder, key)
 			} else {
-				_, err = e.handle.WriteToIP(e.buf.Bytes(), &net.IPAddr{IP: raddr.IP})
+				delete(conn.flowQueues, key)
 			}
-			// increase seq in flow
-			e.seq += uint32(len(p))
-			n = len(p)
-		})
+			conn.flowQueued--
+		} else {
+			conn.queue[0] = message{}
+			conn.queue = conn.queue[1:]
+		}
+		conn.resumeQueue()
+		conn.queueLock.Unlock()
 	}
+}
+
+// ReadFrom implements the PacketConn ReadFrom method, the part of a packet
+// beyond len(p) is discarded.
+func (conn *TCPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, _, err = conn.ReadFromMeta(p)
 	return
 }
 
-// Close closes the connection.
-func (conn *TCPConn) Close() error {
+// ReadFromMeta acts like ReadFrom, and also returns the header fields of the
+// TCP segment that delivered the packet.
+func (conn *TCPConn) ReadFromMeta(p []byte) (n int, addr net.Addr, meta PacketMeta, err error) {
+	msg, err := conn.readMessage(context.Background())
+	if err != nil {
+		return 0, nil, meta, err
+	}
+	return copy(p, msg.bts), msg.addr, msg.meta, nil
+}
+
+// ReadFromPacket acts like ReadFrom, and also returns the decoded TCP segment that
+// delivered the packet, with all its layers, or nil unless it was captured after
+// SetKeepPackets(true). The segment owns its bytes, and lives as long as the caller
+// keeps it.
+func (conn *TCPConn) ReadFromPacket(p []byte) (n int, addr net.Addr, pkt gopacket.Packet, err error) {
+	msg, err := conn.readMessage(context.Background())
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return copy(p, msg.bts), msg.addr, msg.packet, nil
+}
+
+// readMessage waits for the next message until the read deadline, or until ctx is done
+func (conn *TCPConn) readMessage(ctx context.Context) (message, error) {
+	var timer *time.Timer
+	var deadline <-chan time.Time
+	if d, ok := conn.readDeadline.Load().(time.Time); ok && !d.IsZero() {
+		if !time.Now().Before(d) {
+			return message{}, errTimeout
+		}
+		timer = time.NewTimer(time.Until(d))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case <-deadline:
+		return message{}, errTimeout
+	case <-conn.die:
+		return message{}, ErrClosed
+	case <-ctx.Done():
+		return message{}, ctx.Err()
+	case msg := <-conn.chMessage:
+		return msg, nil
+	}
+}
+
+// ReadFromContext acts like ReadFrom, but returns ctx.Err() if ctx is done
+// before a packet arrives. The read deadline applies as well.
+func (conn *TCPConn) ReadFromContext(ctx context.Context, p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	default:
+	}
+
+	msg, err := conn.readMessage(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(p, msg.bts), msg.addr, nil
+}
+
+// DrainRead passes the packets already captured but not read yet to handler without
+// blocking, e.g. before Close so they aren't lost, and returns the number drained.
+func (conn *TCPConn) DrainRead(handler func(p []byte, addr net.Addr)) int {
+	var n int
+	for {
+		select {
+		case packet := <-conn.chMessage:
+			handler(packet.bts, packet.addr)
+			n++
+			continue
+		default:
+		}
+
+		// wait for the pump to hand over the rest of the read queue
+		conn.queueLock.Lock()
+		queued := conn.queued()
+		conn.queueLock.Unlock()
+		if queued == 0 {
+			return n
+		}
+		select {
+		case packet := <-conn.chMessage:
+			handler(packet.bts, packet.addr)
+			n++
+		case <-conn.die:
+			return n
+		}
+	}
+}
+
+// WriteTo implements the PacketConn WriteTo method, the packet carries the
+// flags set by SetTCPFlags. Packets to a peer that hasn't been seen yet are
+// dropped silently, like an unreliable datagram. An empty p sends a pure ACK,
+// with PSH cleared, e.g. as a keepalive or window update, which doesn't advance
+// the sequence number.
+func (conn *TCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	return conn.writeTo(context.Background(), p, addr)
+}
+
+// writeTo implements WriteTo, ctx cancels the waits for pacing and the write concurrency limit
+func (conn *TCPConn) writeTo(ctx context.Context, p []byte, addr net.Addr) (n int, err error) {
+	if err := conn.checkWriteSize(p); err != nil {
+		return 0, err
+	}
+	if len(p) == 0 {
+		return conn.writeToWithFlags(ctx, nil, addr, TCPFlags(atomic.LoadUint32(&conn.flags))&^FlagPSH)
+	}
+	if atomic.LoadInt32(&conn.coalesce) != 0 {
+		if d, ok := conn.writeDeadline.Load().(time.Time); ok && !d.IsZero() && !time.Now().Before(d) {
+			return 0, errTimeout
+		}
+
+		select {
+		case <-conn.die:
+			return 0, ErrClosed
+		default:
+			return conn.buffer(ctx, p, addr)
+		}
+	}
+	return conn.writeToWithFlags(ctx, p, addr, TCPFlags(atomic.LoadUint32(&conn.flags)))
+}
+
+// checkWriteSize returns errWriteSize if p is larger than the limit of SetMaxWriteSize
+func (conn *TCPConn) checkWriteSize(p []byte) error {
+	if max := atomic.LoadInt32(&conn.maxWriteSize); max > 0 && len(p) > int(max) {
+		return errWriteSize
+	}
+	return nil
+}
+
+// buffer appends p to the payload pending for addr, and sends it once large enough
+func (conn *TCPConn) buffer(ctx context.Context, p []byte, addr net.Addr) (n int, err error) {
+	if err, ok := conn.resetErr.Load().(error); ok {
+		return 0, err
+	}
+
+	var full bool
+	conn.lockflow(addr, func(e *tcpFlow) {
+		// the payload buffered before is lost, report it before buffering more
+		if e.flushErr != nil {
+			err = e.flushErr
+			e.flushErr = nil
+			return
+		}
+
+		// same as output, the packet is lost without a handle
+		if e.handle == nil {
+			return
+		}
+
+		e.pending = append(e.pending, p...)
+		if len(e.pending) >= coalesceSize {
+			full = true
+		} else if e.flushTimer == nil {
+			e.flushTimer = time.AfterFunc(coalesceDelay, func() {
+				if err := conn.flushflow(context.Background(), addr); err != nil {
+					conn.flowsLock.Lock()
+					if e := conn.flowTable[addr.String()]; e != nil {
+						e.flushErr = err
+					}
+					conn.flowsLock.Unlock()
+				}
+			})
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if full {
+		if err := conn.flushflow(ctx, addr); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// ackflow sends a pure ack to addr if inbound data is still waiting for one
+func (conn *TCPConn) ackflow(addr net.Addr) {
+	var pending bool
+	conn.lockflow(addr, func(e *tcpFlow) {
+		pending = e.ackPending > 0
+		e.ackTimer = nil
+	})
+	if pending {
+		conn.output(nil, addr, FlagACK, 0, nil)
+	}
+}
+
+// flushflow sends the payload pending for addr in a single segment
+func (conn *TCPConn) flushflow(ctx context.Context, addr net.Addr) error {
+	select {
+	case <-conn.die:
+		return ErrClosed
+	default:
+	}
+
+	var pending []byte
+	conn.lockflow(addr, func(e *tcpFlow) {
+		pending = e.pending
+		e.pending = nil
+		if e.flushTimer != nil {
+			e.flushTimer.Stop()
+			e.flushTimer = nil
+		}
+	})
+
+	if len(pending) == 0 {
+		return nil
+	}
+	_, err := conn.outputContext(ctx, pending, addr, TCPFlags(atomic.LoadUint32(&conn.flags)), 0, nil)
+	return err
+}
+
+// pace blocks until the token bucket allows n more bytes to be sent, or ctx is done
+func (conn *TCPConn) pace(ctx context.Context, n int) error {
+	conn.paceLock.Lock()
+	if conn.paceRate <= 0 || n == 0 {
+		conn.paceLock.Unlock()
+		return nil
+	}
+
+	// refill, allowing bursts of up to 100ms worth of tokens
+	now := time.Now()
+	conn.paceTokens += now.Sub(conn.paceLast).Seconds() * conn.paceRate
+	conn.paceLast = now
+	burst := conn.paceRate / 10
+	if burst < float64(n) {
+		burst = float64(n)
+	}
+	if conn.paceTokens > burst {
+		conn.paceTokens = burst
+	}
+
+	// take the tokens in advance, and wait for the debt to be repaid
+	conn.paceTokens -= float64(n)
+	var wait time.Duration
+	if conn.paceTokens < 0 {
+		wait = time.Duration(-conn.paceTokens / conn.paceRate * float64(time.Second))
+	}
+	conn.paceLock.Unlock()
+
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-conn.die:
+		case <-ctx.Done():
+			// give back the tokens of the bytes not sent
+			conn.paceLock.Lock()
+			conn.paceTokens += float64(n)
+			conn.paceLock.Unlock()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Flush sends the payloads buffered by WriteTo when write coalescing is enabled,
+// it also returns the error of a payload that failed to be sent after the delay.
+func (conn *TCPConn) Flush() error {
+	var addrs []net.Addr
 	var err error
-	conn.dieOnce.Do(func() {
-		// signal closing
-		close(conn.die)
+	conn.flowsLock.Lock()
+	for _, e := range conn.flowTable {
+		if len(e.pending) > 0 {
+			addrs = append(addrs, e.addr)
+		}
+		if e.flushErr != nil {
+			if err == nil {
+				err = e.flushErr
+			}
+			e.flushErr = nil
+		}
+	}
+	conn.flowsLock.Unlock()
 
-		// close all established tcp connections
-		if conn.tcpconn != nil { // client
-			setTTL(conn.tcpconn, 64)
-			err = conn.tcpconn.Close()
-		} else if conn.listener != nil {
-			err = conn.listener.Close() // server
-			conn.flowsLock.Lock()
-			for k, v := range conn.flowTable {
-				if v.conn != nil {
-					setTTL(v.conn, 64)
-					v.conn.Close()
+	for _, addr := range addrs {
+		if ferr := conn.flushflow(context.Background(), addr); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// WriteToWithFlags acts like WriteTo, but the crafted segment carries exactly flags
+// instead of the connection defaults. Combinations a real TCP stack would never
+// send (e.g. data without ACK, or SYN with FIN) are likely to be dropped by
+// middleboxes or to get the flow reset by the peer.
+func (conn *TCPConn) WriteToWithFlags(p []byte, addr net.Addr, flags TCPFlags) (n int, err error) {
+	if err := conn.checkWriteSize(p); err != nil {
+		return 0, err
+	}
+	return conn.writeToWithFlags(context.Background(), p, addr, flags)
+}
+
+// writeToWithFlags checks the write deadline and sends p with flags
+func (conn *TCPConn) writeToWithFlags(ctx context.Context, p []byte, addr net.Addr, flags TCPFlags) (n int, err error) {
+	if d, ok := conn.writeDeadline.Load().(time.Time); ok && !d.IsZero() && !time.Now().Before(d) {
+		return 0, errTimeout
+	}
+
+	select {
+	case <-conn.die:
+		return 0, ErrClosed
+	default:
+		return conn.outputContext(ctx, p, addr, flags, 0, nil)
+	}
+}
+
+// WriteToUrgent acts like WriteTo, but the segment also carries the URG flag and
+// urgentPtr as its urgent pointer, the offset from the start of p to the end of
+// the urgent data.
+func (conn *TCPConn) WriteToUrgent(p []byte, addr net.Addr, urgentPtr uint16) (n int, err error) {
+	if err := conn.checkWriteSize(p); err != nil {
+		return 0, err
+	}
+	if d, ok := conn.writeDeadline.Load().(time.Time); ok && !d.IsZero() && !time.Now().Before(d) {
+		return 0, errTimeout
+	}
+
+	select {
+	case <-conn.die:
+		return 0, ErrClosed
+	default:
+	}
+
+	// the urgent data must not overtake the payload buffered before it
+	if atomic.LoadInt32(&conn.coalesce) != 0 {
+		if err := conn.flushflow(context.Background(), addr); err != nil {
+			return 0, err
+		}
+	}
+	return conn.output(p, addr, TCPFlags(atomic.LoadUint32(&conn.flags))|FlagURG, urgentPtr, nil)
+}
+
+// WriteToSeq acts like WriteTo, but the segment carries seq as its sequence number,
+// e.g. to retransmit a segment or to test a peer, and the sequence number of the flow
+// is left unchanged. Data the peer accepts at seq is not accounted for by the flow, so
+// later segments overlap or leave a gap in what the peer has seen, which desynchronizes
+// the flow if misused. The segment isn't retransmitted in reliable mode.
+func (conn *TCPConn) WriteToSeq(p []byte, addr net.Addr, seq uint32) (n int, err error) {
+	if err := conn.checkWriteSize(p); err != nil {
+		return 0, err
+	}
+	if d, ok := conn.writeDeadline.Load().(time.Time); ok && !d.IsZero() && !time.Now().Before(d) {
+		return 0, errTimeout
+	}
+
+	select {
+	case <-conn.die:
+		return 0, ErrClosed
+	default:
+	}
+	return conn.output(p, addr, TCPFlags(atomic.LoadUint32(&conn.flags)), 0, func(uint32) uint32 { return seq })
+}
+
+// WriteToContext acts like WriteTo, but returns ctx.Err() if ctx is done
+// before the packet is sent, including while it waits for pacing, the write
+// concurrency limit or the retries of SetWriteRetries. A payload buffered by
+// write coalescing is sent later, regardless of ctx.
+func (conn *TCPConn) WriteToContext(ctx context.Context, p []byte, addr net.Addr) (n int, err error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+		return conn.writeTo(ctx, p, addr)
+	}
+}
+
+// WriteToAll sends p with WriteTo to every peer of a ready flow, and returns the
+// number of peers written and the first error.
+func (conn *TCPConn) WriteToAll(p []byte) (peers int, err error) {
+	for _, addr := range conn.Peers() {
+		if _, werr := conn.WriteTo(p, addr); werr != nil {
+			if err == nil {
+				err = werr
+			}
+			continue
+		}
+		peers++
+	}
+	return peers, err
+}
+
+// output crafts a TCP segment carrying p with flags and the urgent pointer urgent
+// and sends it to addr, if seqFn is not nil, the segment carries seqFn(seq) as its
+// sequence number and the sequence number of the flow is left unchanged.
+func (conn *TCPConn) output(p []byte, addr net.Addr, flags TCPFlags, urgent uint16, seqFn func(seq uint32) uint32) (n int, err error) {
+	return conn.outputContext(context.Background(), p, addr, flags, urgent, seqFn)
+}
+
+// outputContext acts like output, but gives up with ctx.Err() if ctx is done before the segment is sent
+func (conn *TCPConn) outputContext(ctx context.Context, p []byte, addr net.Addr, flags TCPFlags, urgent uint16, seqFn func(seq uint32) uint32) (n int, err error) {
+	if conn.readOnly {
+		return 0, errReadOnly
+	}
+	if err, ok := conn.resetErr.Load().(error); ok {
+		return 0, err
+	}
+	if err := conn.pace(ctx, len(p)); err != nil {
+		return 0, err
+	}
+
+	raddr, err := net.ResolveTCPAddr("tcp", addr.String())
+	if err != nil {
+		return 0, err
+	}
+
+	lport := conn.laddr.Port
+	portOverride := atomic.LoadUint32(&conn.portOverride)
+	window := conn.window(addr) // out of the flow lock, it may take queueLock
+	prof, _ := conn.profile.Load().(*osProfile)
+
+	sem := conn.writeSem.Load().(chan struct{})
+	select {
+	case sem <- struct{}{}:
+		defer func() { <-sem }()
+	case <-conn.die:
+		return 0, ErrClosed
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	// keep Close from closing the handles under an in-flight send, Close holds
+	// the lock only while closing them, so the wait is short
+	conn.sendLock.RLock()
+	defer conn.sendLock.RUnlock()
+	select {
+	case <-conn.die:
+		return 0, ErrClosed
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+
+	// sends to a flow are ordered by its writeLock, and retried out of the flow table
+	// lock, the flow may be replaced in the table while waiting for it
+	var flow *tcpFlow
+	conn.lockflow(addr, func(e *tcpFlow) { flow = e })
+	var handle packetHandle
+	var packet []byte
+	var seq uint32
+	var built bool
+	for {
+		flow.writeLock.Lock()
+		moved := false
+		conn.lockflow(addr, func(e *tcpFlow) {
+			if e != flow {
+				moved = true
+				return
+			}
+
+			// if the flow doesn't have handle , assume this packet has lost, without notification,
+			// unless it's queued until the flow becomes reachable
+			if e.handle == nil {
+				if len(p) > 0 && seqFn == nil && atomic.LoadInt32(&conn.queueUntilReady) != 0 {
+					if len(e.queued) >= maxQueued {
+						err = errQueueFull
+						return
+					}
+					data := make([]byte, len(p))
+					copy(data, p)
+					e.queued = append(e.queued, segment{data: data, flags: flags})
 				}
-				delete(conn.flowTable, k)
+				n = len(p)
+				return
 			}
-			conn.flowsLock.Unlock()
+
+			// build tcp header with local and remote port, peers added by AddPeer have their own local port
+			if e.conn != nil {
+				lport = e.conn.LocalAddr().(*net.TCPAddr).Port
+			}
+			e.tcpHeader.SrcPort = layers.TCPPort(lport)
+			e.tcpHeader.DstPort = layers.TCPPort(raddr.Port)
+			if src := uint16(portOverride >> 16); src != 0 {
+				e.tcpHeader.SrcPort = layers.TCPPort(src)
+			}
+			if dst := uint16(portOverride); dst != 0 {
+				e.tcpHeader.DstPort = layers.TCPPort(dst)
+			}
+			e.tcpHeader.Window = window
+			e.tcpHeader.Ack = e.ack
+			e.tcpHeader.Seq = e.seq
+			if seqFn != nil {
+				e.tcpHeader.Seq = seqFn(e.seq)
+			}
+			setFlags(&e.tcpHeader, flags)
+			e.tcpHeader.Urgent = urgent
+
+			// clamp MSS and scale the window on crafted handshakes
+			e.tcpHeader.Options = nil
+			if prof != nil {
+				e.tcpHeader.Options = e.profileOptions(prof, conn.random32, atomic.LoadInt32(&conn.mss), byte(atomic.LoadInt32(&conn.wscale)), raddr.IP)
+			} else {
+				if mss := atomic.LoadInt32(&conn.mss); mss > 0 && e.tcpHeader.SYN {
+					opt := layers.TCPOption{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: make([]byte, 2)}
+					binary.BigEndian.PutUint16(opt.OptionData, uint16(mss))
+					e.tcpHeader.Options = append(e.tcpHeader.Options, opt)
+				}
+				if e.tcpHeader.SYN {
+					shift := byte(atomic.LoadInt32(&conn.wscale))
+					e.tcpHeader.Options = append(e.tcpHeader.Options,
+						layers.TCPOption{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+						layers.TCPOption{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{shift}})
+				}
+			}
+
+			// build IP header with src & dst ip for TCP checksum
+			e.tcpHeader.SetNetworkLayerForChecksum(checksumLayer(e.handle.LocalAddr().(*net.IPAddr).IP, raddr.IP))
+
+			e.buf.Clear()
+			gopacket.SerializeLayers(e.buf, conn.opts, &e.tcpHeader, gopacket.Payload(p))
+			packet = e.buf.Bytes()
+			if hook, ok := conn.outboundHook.Load().(func([]byte) []byte); ok && hook != nil {
+				packet = hook(packet)
+			}
+			handle = e.handle
+			seq = e.tcpHeader.Seq
+			built = true
+		})
+		if !moved {
+			break
+		}
+		flow.writeLock.Unlock()
+		conn.lockflow(addr, func(e *tcpFlow) { flow = e })
+	}
+	defer flow.writeLock.Unlock()
+	if !built {
+		return
+	}
+
+	retries := atomic.LoadInt32(&conn.writeRetries)
+	for try := int32(0); ; try++ {
+		if !conn.server { // client handles are connected to the remotes
+			_, err = handle.Write(packet)
+		} else {
+			_, err = handle.WriteToIP(packet, &net.IPAddr{IP: raddr.IP})
 		}
+		if err == nil || try >= retries || !transient(err) {
+			break
+		}
+		timer := time.NewTimer(time.Duration(atomic.LoadInt64(&conn.writeBackoff)) << uint(try))
+		select {
+		case <-timer.C:
+		case <-conn.die: // Close waits for sendLock
+			timer.Stop()
+			return 0, ErrClosed
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		}
+	}
+	if err != nil {
+		return
+	}
+	n = len(p)
 
-		// close handles
-		for k := range conn.handles {
-			conn.handles[k].Close()
+	conn.lockflow(addr, func(e *tcpFlow) {
+		if e != flow { // closed while sending
+			return
 		}
 
-		// delete iptable
-		if conn.iptables != nil {
-			conn.iptables.Delete("filter", "OUTPUT", conn.iprule...)
+		// increase seq in flow
+		if seqFn == nil {
+			e.seq += uint32(len(p))
+		}
+		if n > 0 {
+			now := time.Now()
+			e.sentBytes.add(n, now)
+			conn.sentBytes.add(n, now)
+		}
+
+		// the segment carries the ack, nothing is pending anymore
+		e.ackPending = 0
+		if e.ackTimer != nil {
+			e.ackTimer.Stop()
+			e.ackTimer = nil
+		}
+
+		// time the segment for RTT estimation
+		if len(p) > 0 && seqFn == nil {
+			if e.sent == nil {
+				e.sent = make(map[uint32]time.Time)
+			}
+			if len(e.sent) < maxRTTSamples {
+				e.sent[e.seq] = time.Now()
+			}
+		}
+
+		// keep a copy for retransmission
+		if len(p) > 0 && seqFn == nil && atomic.LoadInt32(&conn.reliable) != 0 && len(e.unacked) < maxUnacked {
+			data := make([]byte, len(p))
+			copy(data, p)
+			e.unacked = append(e.unacked, segment{seq: seq, data: data, flags: flags, sent: time.Now()})
+		}
+	})
+	return
+}
+
+// retransmitter resends the segments not acknowledged within the RTO in reliable mode
+func (conn *TCPConn) retransmitter() {
+	type resend struct {
+		addr net.Addr
+		seg  segment
+	}
+
+	ticker := time.NewTicker(retransmitTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.die:
+			return
+		case <-ticker.C:
+		}
+		if atomic.LoadInt32(&conn.reliable) == 0 {
+			continue
+		}
+
+		var resends []resend
+		now := time.Now()
+		conn.flowsLock.Lock()
+		for _, e := range conn.flowTable {
+			rto := e.rto()
+			k := 0
+			for _, seg := range e.unacked {
+				if now.Sub(seg.sent) >= rto<<uint(seg.retries) {
+					if seg.retries >= maxRetransmits {
+						continue // give up on the segment
+					}
+					seg.retries++
+					seg.sent = now
+					resends = append(resends, resend{e.addr, seg})
+				}
+				e.unacked[k] = seg
+				k++
+			}
+			e.unacked = e.unacked[:k]
+		}
+		conn.flowsLock.Unlock()
+
+		for _, r := range resends {
+			seq := r.seg.seq
+			conn.output(r.seg.data, r.addr, r.seg.flags, 0, func(uint32) uint32 { return seq })
+		}
+	}
+}
+
+// SendSYN crafts a SYN with a random initial sequence number to addr, the
+// peer's SYN-ACK is then answered with an ACK by captureFlow, which completes
+// the TCP handshake without any system TCP connection, the flow is usable by
+// WriteTo and ReadFrom afterwards.
+//
+// EXPERIMENTAL: this diverges from the decoy socket model of Dial and Listen.
+// The local kernel knows nothing about the handshake and will answer the SYN-ACK
+// with a RST, which must be dropped by the caller, e.g. with an iptables rule.
+func (conn *TCPConn) SendSYN(addr net.Addr) error {
+	raddr, err := net.ResolveTCPAddr("tcp", addr.String())
+	if err != nil {
+		return err
+	}
+
+	handle, err := conn.handleFor(raddr.IP)
+	if err != nil {
+		return err
+	}
+	return conn.sendSYN(addr, handle)
+}
+
+// sendSYN starts a crafted handshake to addr on handle
+func (conn *TCPConn) sendSYN(addr net.Addr, handle packetHandle) error {
+	isn := conn.random32()
+	conn.lockflow(addr, func(e *tcpFlow) {
+		e.handle = handle
+		e.seq = isn
+		e.ack = 0
+		e.raw = true
+		e.synSent = true
+	})
+
+	_, err := conn.output(nil, addr, FlagSYN, 0, nil)
+	return err
+}
+
+// SendRST resets the flow of addr: a RST carrying the flow's sequence number is sent
+// to the peer, then the flow is deleted, and the callback of SetOnFlowClosed, if any,
+// is invoked with reason "rst". With no packet captured from the peer yet, there is
+// no handle to reach it nor a sequence number it would accept, and nothing is sent.
+func (conn *TCPConn) SendRST(addr net.Addr) error {
+	conn.flowsLock.Lock()
+	e := conn.flowTable[addr.String()]
+	reachable := e != nil && e.handle != nil
+	conn.flowsLock.Unlock()
+	if !reachable {
+		return errNoHandle
+	}
+
+	if _, err := conn.output(nil, addr, FlagRST|FlagACK, 0, nil); err != nil {
+		return err
+	}
+	if conn.deleteflow(addr) {
+		conn.notifyFlowClosed(addr, "rst")
+	}
+	return nil
+}
+
+// Probe checks whether the peer at addr is alive, by sending a keepalive probe,
+// an empty ACK one byte behind the flow's sequence number which the peer must
+// answer, and waiting up to timeout for any packet from the peer.
+func (conn *TCPConn) Probe(addr net.Addr, timeout time.Duration) error {
+	var probe chan struct{}
+	conn.lockflow(addr, func(e *tcpFlow) {
+		if e.handle == nil {
+			return
+		}
+		if e.probe == nil {
+			e.probe = make(chan struct{})
+		}
+		probe = e.probe
+	})
+	if probe == nil {
+		return errNoHandle
+	}
+
+	if _, err := conn.output(nil, addr, FlagACK, 0, func(seq uint32) uint32 { return seq - 1 }); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-probe:
+		return nil
+	case <-timer.C:
+		return errTimeout
+	case <-conn.die:
+		return ErrClosed
+	}
+}
+
+// ExportFlows serializes the sequence state of all ready flows, so another connection
+// can resume them with ImportFlows, e.g. across a process restart. Writes should be
+// stopped before exporting, or the exported sequence numbers fall behind.
+func (conn *TCPConn) ExportFlows() ([]byte, error) {
+	var flows []exportedFlow
+	conn.flowsLock.Lock()
+	for _, e := range conn.flowTable {
+		if e.ready {
+			flows = append(flows, exportedFlow{Addr: e.addr.String(), Seq: e.seq, Ack: e.ack, PeerScale: e.peerScale})
+		}
+	}
+	conn.flowsLock.Unlock()
+	return json.Marshal(flows)
+}
+
+// ImportFlows seeds the flow table with flows serialized by ExportFlows, they are
+// ready at once on the handle routing to each peer. Resumed flows have no system
+// TCP connection, so as with SendSYN, the local kernel will answer the peers'
+// packets with RSTs unless these are dropped, e.g. by an iptables rule.
+func (conn *TCPConn) ImportFlows(b []byte) error {
+	var flows []exportedFlow
+	if err := json.Unmarshal(b, &flows); err != nil {
+		return err
+	}
+
+	for _, f := range flows {
+		raddr, err := net.ResolveTCPAddr("tcp", f.Addr)
+		if err != nil {
+			return err
+		}
+		handle, err := conn.handleFor(raddr.IP)
+		if err != nil {
+			return err
+		}
+
+		conn.lockflow(raddr, func(e *tcpFlow) {
+			e.handle = handle
+			e.seq = f.Seq
+			e.ack = f.Ack
+			e.synced = true
+			e.peerScale = f.PeerScale
+			e.raw = true
+			e.ready = true
+		})
+	}
+	return nil
+}
+
+// handleFor returns the handle to send packets to ip
+func (conn *TCPConn) handleFor(ip net.IP) (*net.IPConn, error) {
+	if !conn.server { // client handles are connected to the remotes
+		conn.captureLock.Lock()
+		defer conn.captureLock.Unlock()
+		for k := range conn.handles {
+			if conn.handles[k].RemoteAddr().(*net.IPAddr).IP.Equal(ip) {
+				return conn.handles[k], nil
+			}
+		}
+		return nil, errNoHandle
+	}
+
+	// find the local address the kernel routes through
+	udpconn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: 9})
+	if err != nil {
+		return nil, err
+	}
+	laddr := udpconn.LocalAddr().(*net.UDPAddr)
+	udpconn.Close()
+
+	conn.captureLock.Lock()
+	defer conn.captureLock.Unlock()
+	for k := range conn.handles {
+		if conn.handles[k].LocalAddr().(*net.IPAddr).IP.Equal(laddr.IP) {
+			return conn.handles[k], nil
+		}
+	}
+	return nil, errNoHandle
+}
+
+// Close closes the connection.
+func (conn *TCPConn) Close() error {
+	var err error
+	conn.dieOnce.Do(func() {
+		// signal closing
+		close(conn.die)
+
+		// close all established tcp connections
+		if conn.tcpconn != nil { // client
+			if !conn.keepTTL {
+				setTTL(conn.tcpconn, 64)
+			}
+			err = conn.tcpconn.Close()
+		} else if conn.listener != nil {
+			err = conn.listener.Close() // server
+		}
+		conn.flowsLock.Lock()
+		for k, v := range conn.flowTable {
+			if v.conn == conn.tcpconn {
+				v.conn = nil
+			}
+			v.close(conn.keepTTL)
+			delete(conn.flowTable, k)
+		}
+		conn.single = nil
+		conn.flowsLock.Unlock()
+
+		// close handles once in-flight sends are done, later ones see die
+		conn.sendLock.Lock()
+		conn.captureLock.Lock()
+		for k := range conn.handles {
+			conn.handles[k].Close()
+		}
+		for k := range conn.icmpHandles {
+			conn.icmpHandles[k].Close()
+		}
+		conn.captureLock.Unlock()
+		conn.sendLock.Unlock()
+
+		// delete iptable
+		for _, rule := range conn.iprules {
+			conn.iptables.Delete("filter", "OUTPUT", rule...)
+		}
+		for _, rule := range conn.ip6rules {
+			conn.ip6tables.Delete("filter", "OUTPUT", rule...)
+		}
+	})
+	return err
+}
+
+// Wait blocks until the goroutines capturing on the handles have exited, which they do
+// once Close has closed the handles, e.g. to make sure a shut down connection leaks no
+// goroutine or delivers no more packets to the callbacks. Before Close, it blocks until
+// the connection is closed.
+func (conn *TCPConn) Wait() {
+	conn.readers.Wait()
+}
+
+// IsClosed reports whether Close has been called.
+func (conn *TCPConn) IsClosed() bool {
+	select {
+	case <-conn.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// LocalAddr returns the local network address.
+func (conn *TCPConn) LocalAddr() net.Addr {
+	if conn.laddr == nil {
+		return nil
+	}
+	return conn.laddr
+}
+
+// IsServer reports whether the connection was created by Listen and serves many
+// peers, rather than created by Dial to talk to a single remote.
+func (conn *TCPConn) IsServer() bool {
+	return conn.server
+}
+
+// SetDeadline implements the Conn SetDeadline method.
+func (conn *TCPConn) SetDeadline(t time.Time) error {
+	if err := conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	if err := conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetReadDeadline implements the Conn SetReadDeadline method.
+func (conn *TCPConn) SetReadDeadline(t time.Time) error {
+	conn.readDeadline.Store(t)
+	return nil
+}
+
+// SetWriteDeadline implements the Conn SetWriteDeadline method.
+func (conn *TCPConn) SetWriteDeadline(t time.Time) error {
+	conn.writeDeadline.Store(t)
+	return nil
+}
+
+// SetDSCP sets the 6bit DSCP field in IPv4 header, or 8bit Traffic Class in IPv6 header.
+func (conn *TCPConn) SetDSCP(dscp int) error {
+	for _, handle := range conn.Handles() {
+		if err := setDSCP(handle, dscp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetNoDelay controls whether WriteTo sends each payload in its own segment,
+// the default. With noDelay false, small payloads to the same peer are buffered
+// and sent together in one segment once they add up to about a full segment, or
+// after a short delay, or on Flush; WriteTo then returns as soon as p is buffered.
+// A payload that fails to be sent after the delay is lost, its error is returned
+// by the next WriteTo to the peer, or by Flush. Note that coalescing merges the
+// boundaries of packets written.
+func (conn *TCPConn) SetNoDelay(noDelay bool) {
+	if noDelay {
+		atomic.StoreInt32(&conn.coalesce, 0)
+		conn.Flush()
+	} else {
+		atomic.StoreInt32(&conn.coalesce, 1)
+	}
+}
+
+// SetReliable turns on retransmission of the payloads not acknowledged by the peer
+// within a timeout derived from the RTT, without it delivery is best effort. Each
+// segment is retried up to 8 times. Both ends must enable it: an end in reliable
+// mode acknowledges every data segment, and delivers only in-order data, dropping
+// duplicates and segments past a gap until the gap is retransmitted. Turning it
+// off discards the segments waiting for retransmission.
+func (conn *TCPConn) SetReliable(reliable bool) {
+	if !reliable {
+		atomic.StoreInt32(&conn.reliable, 0)
+		conn.flowsLock.Lock()
+		for _, e := range conn.flowTable {
+			e.unacked = nil
+		}
+		conn.flowsLock.Unlock()
+		return
+	}
+	atomic.StoreInt32(&conn.reliable, 1)
+	conn.retransmitOnce.Do(func() { go conn.retransmitter() })
+}
+
+// SetSeqRand replaces crypto/rand as the random source of the initial sequence numbers
+// of crafted SYNs and of the advertised windows, e.g. with a seeded source to make tests
+// deterministic. A nil source restores crypto/rand.
+func (conn *TCPConn) SetSeqRand(source mrand.Source) {
+	conn.randLock.Lock()
+	defer conn.randLock.Unlock()
+	if source == nil {
+		conn.seqRand = nil
+		return
+	}
+	conn.seqRand = mrand.New(source)
+}
+
+// random32 returns a random number from the source set by SetSeqRand
+func (conn *TCPConn) random32() uint32 {
+	conn.randLock.Lock()
+	defer conn.randLock.Unlock()
+	if conn.seqRand != nil {
+		return conn.seqRand.Uint32()
+	}
+	var v uint32
+	binary.Read(rand.Reader, binary.LittleEndian, &v)
+	return v
+}
+
+// SetDelayedAck makes the connection acknowledge inbound data on its own, with a pure
+// ack once count data segments are waiting for one, or timeout after the first of them,
+// unless a segment sent meanwhile carried the ack. The kernel's acks never reach the
+// peer, so without it a flow the application rarely writes to leaves the peer's data
+// unacknowledged. A count of 0, the default, disables it, a timeout of 0 acks on the
+// count only. It takes over the per-segment acks of reliable mode.
+func (conn *TCPConn) SetDelayedAck(count int, timeout time.Duration) {
+	atomic.StoreInt64(&conn.ackDelay, int64(timeout))
+	atomic.StoreInt32(&conn.ackCount, int32(count))
+}
+
+// SetWriteRetries retries a send failing with a transient error, i.e. the socket send
+// buffer or the memory for packets running out, up to n times, waiting backoff before
+// the first retry and doubling it for each of the next ones. The segment isn't counted
+// in the flow's sequence numbers until it is sent. Retries only hold up the later writes
+// to the same flow. 0 retries, the default, fails at once.
+func (conn *TCPConn) SetWriteRetries(n int, backoff time.Duration) {
+	atomic.StoreInt64(&conn.writeBackoff, int64(backoff))
+	atomic.StoreInt32(&conn.writeRetries, int32(n))
+}
+
+// SetQueueUntilReady makes writes to a flow that has no handle yet, i.e. before any
+// packet from the peer arrived, queue the payload instead of dropping it, and the
+// queue is sent as soon as the flow can be reached. Up to 64 payloads are queued per
+// flow, further writes fail until then. Turning it off discards the queued payloads.
+func (conn *TCPConn) SetQueueUntilReady(queue bool) {
+	if queue {
+		atomic.StoreInt32(&conn.queueUntilReady, 1)
+		return
+	}
+	atomic.StoreInt32(&conn.queueUntilReady, 0)
+	conn.flowsLock.Lock()
+	for _, e := range conn.flowTable {
+		e.queued = nil
+	}
+	conn.flowsLock.Unlock()
+}
+
+// SetQueueWatermarks queues captured packets in front of ReadFrom, capture stops
+// reading the handles once high packets are waiting, and resumes when readers have
+// drained them to low, meanwhile the kernel receive buffers absorb the bursts, see
+// SetReadBuffer. Without watermarks, capture blocks on each packet until it is read.
+// Both 0 removes the watermarks.
+func (conn *TCPConn) SetQueueWatermarks(low, high int) error {
+	if !(low == 0 && high == 0) && (low < 0 || low >= high) {
+		return errWatermarks
+	}
+
+	conn.queueLock.Lock()
+	conn.startPump()
+	conn.queueLow = low
+	conn.queueHigh = high
+	if high == 0 && conn.queuePaused {
+		conn.queuePaused = false
+		close(conn.queueResume)
+	}
+	conn.resumeQueue()
+	conn.queueLock.Unlock()
+	return nil
+}
+
+// SetFlowQueueLimit queues captured packets per flow in front of ReadFrom, and hands
+// them to readers a packet of each flow in turn, so a peer sending faster than its
+// packets are read can't hold up the others. Once n packets of a flow are waiting,
+// its further packets are dropped, and counted in CaptureStats.Overflowed. The
+// watermarks of SetQueueWatermarks, if any, count the packets of all flows. Packets
+// queued when the limit changes may be delivered out of order. 0 removes the limit.
+func (conn *TCPConn) SetFlowQueueLimit(n int) error {
+	if n < 0 {
+		return errFlowQueueLimit
+	}
+
+	conn.queueLock.Lock()
+	conn.startPump()
+	if conn.flowQueues == nil {
+		conn.flowQueues = make(map[string][]message)
+	}
+	conn.flowQueueLimit = n
+	conn.queueLock.Unlock()
+	return nil
+}
+
+// SetMSSClamp caps the maximum segment size advertised to peers, so they don't
+// send segments larger than mss. It applies to the SYNs crafted by SendSYN, and
+// on a listener also to the handshakes the kernel performs for later connections,
+// a dialed connection is already established. 0 stops clamping crafted SYNs, but
+// can't lift the limit from the listening socket.
+func (conn *TCPConn) SetMSSClamp(mss int) error {
+	if mss < 0 || mss > 65535 {
+		return errMSS
+	}
+	if conn.listener != nil && mss > 0 {
+		if err := setMSS(conn.listener, mss); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&conn.mss, int32(mss))
+	return nil
+}
+
+// SetPacing limits the rate of payload bytes sent by the connection to bytesPerSecond,
+// writers block until the rate allows their packets out. 0 disables pacing, the default.
+func (conn *TCPConn) SetPacing(bytesPerSecond int) {
+	conn.paceLock.Lock()
+	conn.paceRate = float64(bytesPerSecond)
+	conn.paceTokens = 0
+	conn.paceLast = time.Now()
+	conn.paceLock.Unlock()
+}
+
+// SetFlowCreationRate limits how many new flows each source IP may create per second,
+// with bursts of up to a second worth of flows, packets that would create a flow beyond
+// the rate are dropped, while existing flows are unaffected. 0 disables the limit, the
+// default.
+func (conn *TCPConn) SetFlowCreationRate(perSourcePerSecond int) {
+	conn.flowRateLock.Lock()
+	atomic.StoreInt32(&conn.flowRate, int32(perSourcePerSecond))
+	conn.flowBuckets = nil
+	conn.flowRateLock.Unlock()
+}
+
+// allowFlow reports whether a packet from src may go on, i.e. its flow exists, or the
+// source is within the flow creation rate, which then takes a token
+func (conn *TCPConn) allowFlow(src *net.TCPAddr) bool {
+	if atomic.LoadInt32(&conn.flowRate) <= 0 {
+		return true
+	}
+
+	conn.flowsLock.Lock()
+	exists := (conn.single != nil && sameAddr(conn.single.addr, src)) || conn.flowTable[src.String()] != nil
+	conn.flowsLock.Unlock()
+	if exists {
+		return true
+	}
+
+	conn.flowRateLock.Lock()
+	defer conn.flowRateLock.Unlock()
+	rate := float64(atomic.LoadInt32(&conn.flowRate))
+	if rate <= 0 {
+		return true
+	}
+	if conn.flowBuckets == nil {
+		conn.flowBuckets = make(map[string]*flowBucket)
+	}
+	now := time.Now()
+	key := src.IP.String()
+	b := conn.flowBuckets[key]
+	if b == nil {
+		b = &flowBucket{tokens: rate, last: now}
+		conn.flowBuckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	b.last = now
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// pruneFlowBuckets forgets the sources whose token buckets have refilled
+func (conn *TCPConn) pruneFlowBuckets() {
+	conn.flowRateLock.Lock()
+	defer conn.flowRateLock.Unlock()
+	for k, b := range conn.flowBuckets {
+		if time.Since(b.last) > time.Second {
+			delete(conn.flowBuckets, k)
+		}
+	}
+}
+
+// SetSerializeOptions sets the options used to serialize crafted packets, the default
+// fixes lengths and computes checksums. Disabling ComputeChecksums saves CPU on NICs
+// with TX checksum offload, but packets with bad checksums are dropped elsewhere.
+func (conn *TCPConn) SetSerializeOptions(opts gopacket.SerializeOptions) {
+	conn.flowsLock.Lock()
+	conn.opts = opts
+	conn.flowsLock.Unlock()
+}
+
+// SetKeepPackets makes capture keep the decoded TCP segment of each delivered packet,
+// for ReadFromPacket. Each segment is then copied out of the capture buffer, and the
+// queued packets hold their segments in memory until read.
+func (conn *TCPConn) SetKeepPackets(keep bool) {
+	var v int32
+	if keep {
+		v = 1
+	}
+	atomic.StoreInt32(&conn.keepPackets, v)
+}
+
+// SetDecodeOptions sets the options used to decode captured packets, the default is
+// NoCopy and Lazy. The payloads returned by ReadFrom are copied whatever the options,
+// only the packets passed to the inbound hook share the capture buffer with NoCopy.
+func (conn *TCPConn) SetDecodeOptions(opts gopacket.DecodeOptions) {
+	conn.decodeOpts.Store(opts)
+}
+
+// SetWindowScale sets the window scale shift advertised on the SYNs crafted by
+// SendSYN, the default is 7. The peer then multiplies the windows of crafted
+// segments by 1<<shift, so up to 1<<(16+shift) bytes can be in flight.
+func (conn *TCPConn) SetWindowScale(shift uint8) error {
+	if shift > 14 {
+		return errWindowScale
+	}
+	atomic.StoreInt32(&conn.wscale, int32(shift))
+	return nil
+}
+
+// SetOSProfile makes crafted segments mimic the TCP/IP stack of an OS: the TTL or hop
+// limit of the current handles, the window advertised, the window scale of SetWindowScale,
+// and the options of SYNs in the OS's order, with the MSS of an ethernet link unless
+// clamped by SetMSSClamp. With the Linux profile, segments also carry timestamps on a
+// 1000Hz clock with a random offset per flow, once the peer sends them. SetWindowScale,
+// SetMaxWindow and SetDynamicWindow still apply afterwards. The IP ID is chosen by the
+// kernel, which builds the IP headers. OSProfileNone restores the default fields.
+func (conn *TCPConn) SetOSProfile(profile OSProfile) error {
+	ttl := -1 // the kernel's default
+	wscale := uint8(defaultWindowScale)
+	prof := osProfiles[profile]
+	if prof != nil {
+		ttl = prof.ttl
+		wscale = prof.wscale
+	} else if profile != OSProfileNone {
+		return errOSProfile
+	}
+
+	for _, handle := range conn.Handles() {
+		if err := setHopLimit(handle, ttl); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&conn.wscale, int32(wscale))
+	conn.profile.Store(prof)
+	return nil
+}
+
+// SetPorts overrides the source and destination ports of every crafted segment, in
+// place of the ports of the flow, e.g. to test a NAT rewriting them, 0 keeps the port
+// of the flow. The flows, the system TCP connections and the capture keep their own
+// ports, so unless the path rewrites the ports back, the peer's answers are not
+// captured, or are resets from a port with no connection. It's a testing hook.
+func (conn *TCPConn) SetPorts(src, dst int) error {
+	if src < 0 || src > 65535 || dst < 0 || dst > 65535 {
+		return errPort
+	}
+	atomic.StoreUint32(&conn.portOverride, uint32(src)<<16|uint32(dst))
+	return nil
+}
+
+// SetMaxWriteSize makes the writes of more than n bytes fail with an error instead
+// of being sent, to catch an oversized buffer passed by mistake. It caps each call,
+// independently of the MTU, and of the coalescing of SetNoDelay, which may still
+// send larger segments. An empty write stays a pure ACK. 0 or less removes the limit.
+func (conn *TCPConn) SetMaxWriteSize(n int) {
+	if n < 0 || n > math.MaxInt32 {
+		n = 0
+	}
+	atomic.StoreInt32(&conn.maxWriteSize, int32(n))
+}
+
+// SetMaxWindow caps the windows advertised on crafted segments, which are random
+// between 32768 and 65535 by default, 0 removes the cap. The peer scales them by
+// the shift of SetWindowScale.
+func (conn *TCPConn) SetMaxWindow(window uint16) {
+	atomic.StoreInt32(&conn.maxWindow, int32(window))
+}
+
+// SetDynamicWindow ties the advertised windows to the read backlog, as a real
+// receiver does: the maximum window of SetMaxWindow is advertised while the read
+// queues are empty, and shrinks down to a sixteenth of it as they fill up towards
+// the high watermark of SetQueueWatermarks, or the limit of SetFlowQueueLimit for
+// the flow, then grows back as ReadFrom drains them. Without either, the window
+// stays at the maximum.
+func (conn *TCPConn) SetDynamicWindow(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&conn.dynamicWindow, v)
+}
+
+// window returns the window to advertise to addr
+func (conn *TCPConn) window(addr net.Addr) uint16 {
+	max := uint16(atomic.LoadInt32(&conn.maxWindow))
+	if max == 0 {
+		max = 0xffff
+	}
+	if atomic.LoadInt32(&conn.dynamicWindow) == 0 {
+		window := uint16(conn.random32()) | 0x8000 // make sure it's larger than 32768
+		if prof, _ := conn.profile.Load().(*osProfile); prof != nil {
+			window = prof.window
+		}
+		if window > max {
+			window = max
+		}
+		return window
+	}
+
+	// the free share of the fullest read queue
+	free := 1.0
+	conn.queueLock.Lock()
+	if conn.queueHigh > 0 {
+		if f := 1 - float64(conn.queued())/float64(conn.queueHigh); f < free {
+			free = f
+		}
+	}
+	if conn.flowQueueLimit > 0 {
+		if f := 1 - float64(len(conn.flowQueues[addr.String()]))/float64(conn.flowQueueLimit); f < free {
+			free = f
+		}
+	}
+	conn.queueLock.Unlock()
+
+	if free < 1.0/16 {
+		free = 1.0 / 16
+	}
+	return uint16(float64(max) * free)
+}
+
+// SetTCPFlags sets the flags carried by the data segments crafted in WriteTo,
+// the default is PSH|ACK. ACK is always kept so that data segments remain
+// acceptable to the peer, use WriteToWithFlags to send a segment without it.
+func (conn *TCPConn) SetTCPFlags(flags TCPFlags) {
+	atomic.StoreUint32(&conn.flags, uint32(flags|FlagACK))
+}
+
+// SetBPFFilter attaches a classic BPF program to all handles, replacing the current one,
+// a nil filter detaches it. The program sees packets as the raw sockets receive them,
+// starting from the IPv4 header on IPv4 handles, or the TCP header on IPv6 handles.
+// If any handle rejects the program, the previous one is restored on all handles. On
+// the IPv4 handles of a listener with AllowedHosts, it runs behind the allowlist.
+// Note that an incorrect filter can stop the connection from capturing its own traffic.
+func (conn *TCPConn) SetBPFFilter(filter []bpf.RawInstruction) error {
+	conn.filterLock.Lock()
+	defer conn.filterLock.Unlock()
+	conn.captureLock.Lock()
+	defer conn.captureLock.Unlock()
+	for k := range conn.handles {
+		if err := attachFilter(conn.handles[k], conn.program(conn.handles[k], filter)); err != nil {
+			for i := 0; i < k; i++ {
+				conn.restoreFilter(conn.handles[i])
+			}
+			return err
+		}
+	}
+	conn.filter = filter
+	conn.ebpfSet = false
+	return nil
+}
+
+// SetEBPFFilter attaches the eBPF socket filter program loaded by the caller as fd to
+// all handles, in place of the program of SetBPFFilter, e.g. a program exact-matching
+// the four-tuples at a high packet rate. The program must be of type
+// BPF_PROG_TYPE_SOCKET_FILTER, and sees the packets as a classic one does. fd must stay
+// open until the program is replaced or the connection closed, it is also attached to
+// the handles of AddPeer. It also replaces the kernel-side allowlist of AllowedHosts,
+// which is then only applied after capture. A negative fd detaches it. If any handle
+// rejects the program, the previous one is restored on all handles.
+func (conn *TCPConn) SetEBPFFilter(fd int) error {
+	conn.filterLock.Lock()
+	defer conn.filterLock.Unlock()
+	conn.captureLock.Lock()
+	defer conn.captureLock.Unlock()
+	for k := range conn.handles {
+		var err error
+		if fd < 0 {
+			err = attachFilter(conn.handles[k], conn.program(conn.handles[k], nil))
+		} else {
+			err = attachEBPF(conn.handles[k], fd)
+		}
+		if err != nil {
+			for i := 0; i < k; i++ {
+				conn.restoreFilter(conn.handles[i])
+			}
+			return err
+		}
+	}
+	conn.filter = nil
+	conn.ebpf = fd
+	conn.ebpfSet = fd >= 0
+	return nil
+}
+
+// restoreFilter attaches the current program to handle, filterLock must be held
+func (conn *TCPConn) restoreFilter(handle *net.IPConn) error {
+	if conn.ebpfSet {
+		return attachEBPF(handle, conn.ebpf)
+	}
+	return attachFilter(handle, conn.program(handle, conn.filter))
+}
+
+// program returns the classic BPF program attached to handle for the filter of
+// SetBPFFilter, behind the allowlist on IPv4 handles, nil for none
+func (conn *TCPConn) program(handle *net.IPConn, filter []bpf.RawInstruction) []bpf.RawInstruction {
+	local, ok := handle.LocalAddr().(*net.IPAddr)
+	if conn.allowProgram == nil || !ok || local.IP.To4() == nil {
+		return filter
+	}
+	prog := conn.allowProgram[:len(conn.allowProgram):len(conn.allowProgram)]
+	if filter == nil {
+		prog = append(prog, bpf.RetConstant{Val: math.MaxUint32})
+	}
+	raw, _ := bpf.Assemble(prog)
+	return append(raw, filter...)
+}
+
+// allowlistProgram returns a classic BPF program dropping the IPv4 packets from the
+// sources not in allowed, and falling through to the next instruction for the others,
+// or nil if the addresses are too many for its jumps
+func allowlistProgram(allowed map[string]bool) []bpf.Instruction {
+	var ips []uint32
+	for host := range allowed {
+		if ip := net.ParseIP(host).To4(); ip != nil {
+			ips = append(ips, binary.BigEndian.Uint32(ip))
+		}
+	}
+	if len(ips) > math.MaxUint8 {
+		return nil
+	}
+
+	// the source address is at offset 12 of the IPv4 header
+	prog := []bpf.Instruction{bpf.LoadAbsolute{Off: 12, Size: 4}}
+	for k, ip := range ips {
+		prog = append(prog, bpf.JumpIf{Cond: bpf.JumpEqual, Val: ip, SkipTrue: uint8(len(ips) - k)})
+	}
+	return append(prog, bpf.RetConstant{Val: 0})
+}
+
+// BPFFilters returns the classic BPF program attached to each handle, in the order of
+// Handles, disassembled one instruction per line, with the allowlist of
+// ListenConfig.AllowedHosts in front on IPv4 handles, "ebpf fd N" for the program of
+// SetEBPFFilter, or "" for a handle without one.
+func (conn *TCPConn) BPFFilters() []string {
+	conn.filterLock.Lock()
+	defer conn.filterLock.Unlock()
+	conn.captureLock.Lock()
+	defer conn.captureLock.Unlock()
+
+	filters := make([]string, len(conn.handles))
+	for k := range filters {
+		if conn.ebpfSet {
+			filters[k] = fmt.Sprint("ebpf fd ", conn.ebpf)
+			continue
+		}
+		insts, _ := bpf.Disassemble(conn.program(conn.handles[k], conn.filter))
+		lines := make([]string, len(insts))
+		for i := range insts {
+			lines[i] = fmt.Sprint(insts[i])
+		}
+		filters[k] = strings.Join(lines, "\n")
+	}
+	return filters
+}
+
+// CaptureStats returns the packet counters of the handles, Dropped requires linux 4.6 or later.
+func (conn *TCPConn) CaptureStats() (CaptureStats, error) {
+	stats := CaptureStats{
+		Received:   atomic.LoadUint64(&conn.received),
+		Malformed:  atomic.LoadUint64(&conn.malformed),
+		Overflowed: atomic.LoadUint64(&conn.overflowed),
+	}
+	for _, handle := range conn.Handles() {
+		drops, err := socketDrops(handle)
+		if err != nil {
+			return stats, err
+		}
+		stats.Dropped += drops
+	}
+	return stats, nil
+}
+
+// IsLoopback reports whether handle, one of Handles, captures on loopback, where
+// the handle also sees the packets sent, e.g. to a peer on the same host.
+func (conn *TCPConn) IsLoopback(handle *net.IPConn) bool {
+	conn.captureLock.Lock()
+	defer conn.captureLock.Unlock()
+	for k := range conn.handles {
+		if conn.handles[k] == handle {
+			return conn.loopback[k]
+		}
+	}
+	return false
+}
+
+// SystemConn returns the system TCP connection related to the flow of addr, or nil
+// if there is none. Unless KeepStream is set, its inbound stream is drained and
+// discarded by the package, and reading it as well loses data.
+func (conn *TCPConn) SystemConn(addr net.Addr) *net.TCPConn {
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	if e := conn.flowTable[addr.String()]; e != nil {
+		return e.conn
+	}
+	return nil
+}
+
+// Handles returns the raw IP sockets the connection captures and sends packets on,
+// for tuning options the package doesn't wrap, e.g. through SyscallConn. Closing or
+// reading from a handle breaks the connection.
+func (conn *TCPConn) Handles() []*net.IPConn {
+	conn.captureLock.Lock()
+	defer conn.captureLock.Unlock()
+	handles := make([]*net.IPConn, len(conn.handles))
+	copy(handles, conn.handles)
+	return handles
+}
+
+// SetWriteConcurrency limits how many goroutines may be crafting and sending
+// packets at once, writers beyond the limit block until a slot frees up.
+func (conn *TCPConn) SetWriteConcurrency(n int) error {
+	if n < 1 {
+		return errWriteConcurrency
+	}
+	conn.writeSem.Store(make(chan struct{}, n))
+	return nil
+}
+
+// Peers returns a snapshot of the remote addresses of all ready flows.
+func (conn *TCPConn) Peers() []net.Addr {
+	var addrs []net.Addr
+	conn.flowsLock.Lock()
+	for _, e := range conn.flowTable {
+		if e.ready {
+			addrs = append(addrs, e.addr)
+		}
+	}
+	conn.flowsLock.Unlock()
+	return addrs
+}
+
+// RTT returns the smoothed round-trip time to addr, estimated from the time
+// the peer takes to acknowledge crafted segments, or 0 if there is no sample yet.
+func (conn *TCPConn) RTT(addr net.Addr) time.Duration {
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	if e := conn.flowTable[addr.String()]; e != nil {
+		return e.srtt
+	}
+	return 0
+}
+
+// Throughput returns the payload bytes sent and delivered by all flows of the
+// connection, and their rates over the last 5 seconds.
+func (conn *TCPConn) Throughput() Throughput {
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	return throughput(&conn.sentBytes, &conn.receivedBytes, time.Now())
+}
+
+// FlowThroughput acts like Throughput for the flow of addr alone, the counts
+// start over once the flow is closed or expires.
+func (conn *TCPConn) FlowThroughput(addr net.Addr) Throughput {
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	if e := conn.flowTable[addr.String()]; e != nil {
+		return throughput(&e.sentBytes, &e.receivedBytes, time.Now())
+	}
+	return Throughput{}
+}
+
+// DupAcks returns the number of consecutive duplicate acks from the peer at addr,
+// i.e. segments without data acknowledging the same sequence number as the previous
+// one, reset when the ack moves. A count of 3 or more is the usual sign of a loss.
+func (conn *TCPConn) DupAcks(addr net.Addr) int {
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	if e := conn.flowTable[addr.String()]; e != nil {
+		return e.dupAcks
+	}
+	return 0
+}
+
+// SetOnNewFlow sets a callback invoked with the remote address when a flow
+// becomes ready, i.e. packets from a peer with an established connection are
+// first captured, a nil f removes the callback. It runs on the capture goroutine,
+// so it should return quickly.
+func (conn *TCPConn) SetOnNewFlow(f func(addr net.Addr)) {
+	conn.onNewFlow.Store(f)
+}
+
+// SetOnFlowClosed sets a callback invoked with the remote address when a ready flow
+// is removed, the reason is "fin" or "rst" when the peer tears it down, or "idle"
+// when it expires, a nil f removes the callback.
+func (conn *TCPConn) SetOnFlowClosed(f func(addr net.Addr, reason string)) {
+	conn.onFlowClosed.Store(f)
+}
+
+// SetOnICMP sets a callback invoked with the ICMP and ICMPv6 errors quoting segments
+// of known flows, e.g. to react to path MTU changes or unreachable peers. The first
+// non-nil f opens raw ICMP sockets on the local addresses of the handles, which keep
+// capturing until Close, a nil f removes the callback.
+func (conn *TCPConn) SetOnICMP(f func(ev ICMPEvent)) error {
+	conn.onICMP.Store(f)
+	if f == nil {
+		return nil
+	}
+
+	conn.captureLock.Lock()
+	defer conn.captureLock.Unlock()
+	select {
+	case <-conn.die:
+		return ErrClosed
+	default:
+	}
+	if conn.icmpHandles != nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var handles []*net.IPConn
+	for k := range conn.handles {
+		laddr, ok := conn.handles[k].LocalAddr().(*net.IPAddr)
+		if !ok || seen[laddr.IP.String()] {
+			continue
+		}
+		seen[laddr.IP.String()] = true
+
+		network := "ip6:ipv6-icmp"
+		if laddr.IP.To4() != nil {
+			network = "ip4:icmp"
+		}
+		handle, err := net.ListenIP(network, &net.IPAddr{IP: laddr.IP, Zone: laddr.Zone})
+		if err != nil {
+			for _, h := range handles {
+				h.Close()
+			}
+			return err
+		}
+		handles = append(handles, handle)
+	}
+
+	for _, handle := range handles {
+		conn.readers.Add(1)
+		go conn.captureICMP(handle, handle.LocalAddr().(*net.IPAddr).IP.To4() == nil)
+	}
+	conn.icmpHandles = handles
+	return nil
+}
+
+// captureICMP delivers the ICMP errors read from handle to the SetOnICMP callback
+func (conn *TCPConn) captureICMP(handle *net.IPConn, v6 bool) {
+	defer conn.readers.Done()
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := handle.ReadFromIP(buf)
+		if err != nil {
+			return
+		}
+
+		ev, ok := parseICMP(buf[:n], v6)
+		if !ok {
+			continue
+		}
+
+		// only errors related to a flow are interesting
+		conn.flowsLock.Lock()
+		e := conn.flowTable[ev.Addr.String()]
+		conn.flowsLock.Unlock()
+		if e == nil {
+			continue
+		}
+
+		ev.From = from.IP
+		if f, ok := conn.onICMP.Load().(func(ICMPEvent)); ok && f != nil {
+			f(ev)
+		}
+	}
+}
+
+// parseICMP decodes an ICMP error message b, without the IPv4 header, quoting a TCP
+// segment, the destination of the quoted segment is the remote address of the flow
+func parseICMP(b []byte, v6 bool) (ev ICMPEvent, ok bool) {
+	if len(b) < 8 {
+		return ev, false
+	}
+	ev.Type, ev.Code = b[0], b[1]
+	quoted := b[8:]
+
+	var dst net.IP
+	var hdrlen int
+	if !v6 {
+		if ev.Type != 3 { // destination unreachable
+			return ev, false
+		}
+		if ev.Code == 4 { // fragmentation needed
+			ev.MTU = int(binary.BigEndian.Uint16(b[6:8]))
+		}
+		if len(quoted) < 20 || quoted[9] != uint8(layers.IPProtocolTCP) {
+			return ev, false
+		}
+		hdrlen = int(quoted[0]&0x0f) * 4
+		dst = net.IP(append([]byte(nil), quoted[16:20]...))
+	} else {
+		switch ev.Type {
+		case 1: // destination unreachable
+		case 2: // packet too big
+			ev.MTU = int(binary.BigEndian.Uint32(b[4:8]))
+		default:
+			return ev, false
+		}
+		if len(quoted) < 40 || quoted[6] != uint8(layers.IPProtocolTCP) {
+			return ev, false
+		}
+		hdrlen = 40
+		dst = net.IP(append([]byte(nil), quoted[24:40]...))
+	}
+
+	// the ports are the first 4 bytes of the quoted TCP header
+	if hdrlen < 20 || len(quoted) < hdrlen+4 {
+		return ev, false
+	}
+	ev.Addr = &net.TCPAddr{IP: dst, Port: int(binary.BigEndian.Uint16(quoted[hdrlen+2:]))}
+	return ev, true
+}
+
+// SetOutboundHook sets a hook receiving each crafted TCP segment, from the TCP header
+// on, right before it's sent, the returned slice is sent instead. The hook may modify
+// b in place, but it runs with the flow table locked, so it must not call back into
+// the connection. A nil hook removes it.
+func (conn *TCPConn) SetOutboundHook(hook func(b []byte) []byte) {
+	conn.outboundHook.Store(hook)
+}
+
+// SetInboundHook sets a hook called with each captured packet, decoded from the TCP
+// header on, before the connection processes it, returning false drops the packet.
+// The packet shares the capture buffer, so the hook must not retain it after returning.
+// A nil hook removes it.
+func (conn *TCPConn) SetInboundHook(hook func(packet gopacket.Packet) bool) {
+	conn.inboundHook.Store(hook)
+}
+
+// SetReadBuffer sets the size of the operating system's receive buffer associated with the connection.
+func (conn *TCPConn) SetReadBuffer(bytes int) error {
+	var err error
+	for _, handle := range conn.Handles() {
+		if err := handle.SetReadBuffer(bytes); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// SetWriteBuffer sets the size of the operating system's transmit buffer associated with the connection.
+func (conn *TCPConn) SetWriteBuffer(bytes int) error {
+	var err error
+	for _, handle := range conn.Handles() {
+		if err := handle.SetWriteBuffer(bytes); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// SetCaptureConcurrency sets the number of goroutines capturing packets on each handle,
+// lowering it takes effect as the surplus goroutines receive their next packet.
+// With more than one goroutine, packets from a handle may be delivered out of order.
+func (conn *TCPConn) SetCaptureConcurrency(n int) error {
+	if n < 1 {
+		return errConcurrency
+	}
+	if conn.writeOnly {
+		return errWriteOnly
+	}
+
+	conn.captureLock.Lock()
+	defer conn.captureLock.Unlock()
+	for w := atomic.LoadInt32(&conn.captureWorkers); w < int32(n) && !conn.IsClosed(); w++ {
+		for k := range conn.handles {
+			conn.readers.Add(1)
+			go conn.captureFlow(conn.handles[k], conn.ports[k], w)
+		}
+	}
+	atomic.StoreInt32(&conn.captureWorkers, int32(n))
+	return nil
+}
+
+// addHandle starts capturing packets to the local port on handle
+func (conn *TCPConn) addHandle(handle *net.IPConn, port int) {
+	conn.filterLock.Lock()
+	defer conn.filterLock.Unlock()
+	if conn.filter != nil || conn.ebpfSet || conn.allowProgram != nil {
+		if err := conn.restoreFilter(handle); err != nil {
+			conn.logf("tcpraw: cannot attach the BPF filter to %v: %v", handle.LocalAddr(), err)
+		}
+	}
+
+	// Close has closed the handles already, so must this one be
+	conn.captureLock.Lock()
+	defer conn.captureLock.Unlock()
+	if conn.IsClosed() {
+		handle.Close()
+		return
+	}
+	conn.handles = append(conn.handles, handle)
+	conn.ports = append(conn.ports, port)
+	conn.loopback = append(conn.loopback, isLoopback(handle))
+	for w := int32(0); w < atomic.LoadInt32(&conn.captureWorkers); w++ {
+		conn.readers.Add(1)
+		go conn.captureFlow(handle, port, w)
+	}
+}
+
+// Dial connects to the remote TCP port,
+// and returns a single packet-oriented connection
+func Dial(network, address string) (*TCPConn, error) {
+	var d Dialer
+	return d.Dial(network, address)
+}
+
+// Dial acts like the package-level Dial, with the options in d applied. Unless
+// RawOnly is set, it returns once the handshake of the system TCP connection
+// is captured, which may add up to HandshakeTimeout to the connect time.
+func (d *Dialer) Dial(network, address string) (*TCPConn, error) {
+	if d.Mode == ModeReadOnly || (d.Mode != ModeReadWrite && d.RawOnly) {
+		return nil, errMode
+	}
+
+	// remote address resolve
+	raddr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.SourceIP != nil && !d.FreeBind {
+		if err := checkSourceIP(d.SourceIP, raddr.IP); err != nil {
+			return nil, err
+		}
+	}
+
+	// AF_INET
+	handle, err := dialIP(network, d.SourceIP, raddr.IP, d.Mark, d.FreeBind)
+	if err != nil {
+		return nil, err
+	}
+
+	// create an established tcp connection
+	// will hack this tcp connection for packet transmission
+	var tcpconn *net.TCPConn
+	var laddr *net.TCPAddr
+	if d.RawOnly {
+		laddr = &net.TCPAddr{IP: handle.LocalAddr().(*net.IPAddr).IP, Port: ephemeralPort()}
+	} else {
+		tcpconn, err = dialTCP(network, d.SourceIP, raddr, d.Mark, chainControl(freeBindControl(d.FreeBind), d.Control))
+		if err != nil {
+			handle.Close()
+			return nil, err
+		}
+		laddr = tcpconn.LocalAddr().(*net.TCPAddr)
+	}
+
+	// fields
+	conn := new(TCPConn)
+	conn.die = make(chan struct{})
+	conn.flowTable = make(map[string]*tcpFlow)
+	conn.tcpconn = tcpconn
+	conn.rawOnly = d.RawOnly
+	conn.laddr = laddr
+	conn.raddr = raddr
+	conn.network = network
+	conn.keepTTL = d.KeepTTL
+	conn.keepStream = d.KeepStream
+	conn.synWait = d.HandshakeTimeout
+	if conn.synWait == 0 {
+		conn.synWait = handshakeCaptureTimeout
+	}
+	conn.mark = d.Mark
+	conn.sourceIP = d.SourceIP
+	conn.control = d.Control
+	conn.freeBind = d.FreeBind
+	conn.logger = d.Logger
+	conn.writeOnly = d.Mode == ModeWriteOnly
+	conn.chMessage = make(chan message)
+	conn.lockflow(raddr, func(e *tcpFlow) {
+		e.conn = tcpconn
+		conn.single = e
+	})
+	conn.flags = uint32(defaultFlags)
+	conn.wscale = defaultWindowScale
+	conn.writeSem.Store(make(chan struct{}, defaultWriteConcurrency))
+	conn.opts = gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	if !conn.writeOnly {
+		conn.captureWorkers = 1
+	}
+	conn.addHandle(handle, laddr.Port)
+	go conn.cleaner()
+
+	// the handshake is crafted, the kernel has no socket on the port and must not reset it
+	if d.RawOnly {
+		rule := []string{"-p", "tcp", "--tcp-flags", "RST", "RST", "-d", raddr.IP.String(), "--dport", fmt.Sprint(raddr.Port), "--sport", fmt.Sprint(laddr.Port), "-j", "DROP"}
+		conn.dropTTL(rule, rule)
+		if err := conn.handshake(raddr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	// iptables
+	if !d.KeepTTL {
+		err = setTTL(tcpconn, 1)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		rule4 := []string{"-m", "ttl", "--ttl-eq", "1", "-p", "tcp", "-d", raddr.IP.String(), "--dport", fmt.Sprint(raddr.Port), "-j", "DROP"}
+		rule6 := []string{"-m", "hl", "--hl-eq", "1", "-p", "tcp", "-d", raddr.IP.String(), "--dport", fmt.Sprint(raddr.Port), "-j", "DROP"}
+		conn.dropTTL(rule4, rule6)
+	}
+
+	// the client may speak first, to a server waiting for it
+	if !conn.writeOnly {
+		conn.waitHandshake(raddr)
+	}
+
+	// discard everything
+	if !conn.keepStream {
+		go io.Copy(ioutil.Discard, tcpconn)
+	}
+
+	return conn, nil
+}
+
+// handshake crafts a SYN to raddr and waits for the SYN-ACK, acknowledged by captureFlow
+func (conn *TCPConn) handshake(raddr *net.TCPAddr) error {
+	probe := make(chan struct{})
+	conn.lockflow(raddr, func(e *tcpFlow) { e.probe = probe })
+	if err := conn.SendSYN(raddr); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(rawDialTimeout)
+	defer timer.Stop()
+	select {
+	case <-probe:
+	case <-timer.C:
+		return errTimeout
+	case <-conn.die:
+		return ErrClosed
+	}
+
+	// the first answer may have been a RST
+	var established bool
+	conn.lockflow(raddr, func(e *tcpFlow) { established = e.ready && !e.synSent })
+	if !established {
+		return errConnRefused
+	}
+	return nil
+}
+
+// waitHandshake waits for the flow of a system TCP connection to raddr to become ready,
+// the handle opened before the connection has the SYN-ACK queued, which is then captured
+// at once and makes writes to the silent peer possible, without waiting for its data
+func (conn *TCPConn) waitHandshake(raddr *net.TCPAddr) {
+	if conn.synWait < 0 {
+		return
+	}
+
+	var probe chan struct{}
+	conn.lockflow(raddr, func(e *tcpFlow) {
+		if e.ready {
+			return
+		}
+		if e.probe == nil {
+			e.probe = make(chan struct{})
+		}
+		probe = e.probe
+	})
+	if probe == nil {
+		return
+	}
+
+	timer := time.NewTimer(conn.synWait)
+	defer timer.Stop()
+	select {
+	case <-probe:
+	case <-timer.C:
+		conn.logf("tcpraw: the handshake with %v wasn't captured, writes are dropped until the peer sends", raddr)
+	case <-conn.die:
+	}
+}
+
+// ephemeralPort picks a local port for a raw-only connection in the linux ephemeral range
+func ephemeralPort() int {
+	var v uint16
+	binary.Read(rand.Reader, binary.LittleEndian, &v)
+	return 32768 + int(v)%(60999-32768+1)
+}
+
+// AddPeer connects a dialed connection to one more remote TCP port, so WriteTo
+// and ReadFrom also work with the peer at address, through its own handle and
+// system TCP connection. Like Dial, it waits for the handshake to be captured,
+// up to Dialer.HandshakeTimeout.
+func (conn *TCPConn) AddPeer(address string) error {
+	if conn.tcpconn == nil {
+		return errNotDialed
+	}
+	select {
+	case <-conn.die:
+		return ErrClosed
+	default:
+	}
+
+	raddr, err := net.ResolveTCPAddr(conn.network, address)
+	if err != nil {
+		return err
+	}
+
+	if conn.sourceIP != nil && !conn.freeBind {
+		if err := checkSourceIP(conn.sourceIP, raddr.IP); err != nil {
+			return err
+		}
+	}
+
+	handle, err := dialIP(conn.network, conn.sourceIP, raddr.IP, conn.mark, conn.freeBind)
+	if err != nil {
+		return err
+	}
+
+	tcpconn, err := dialTCP(conn.network, conn.sourceIP, raddr, conn.mark, chainControl(freeBindControl(conn.freeBind), conn.control))
+	if err != nil {
+		handle.Close()
+		return err
+	}
+
+	if !conn.keepTTL {
+		if err := setTTL(tcpconn, 1); err != nil {
+			tcpconn.Close()
+			handle.Close()
+			return err
+		}
+		rule4 := []string{"-m", "ttl", "--ttl-eq", "1", "-p", "tcp", "-d", raddr.IP.String(), "--dport", fmt.Sprint(raddr.Port), "-j", "DROP"}
+		rule6 := []string{"-m", "hl", "--hl-eq", "1", "-p", "tcp", "-d", raddr.IP.String(), "--dport", fmt.Sprint(raddr.Port), "-j", "DROP"}
+		conn.dropTTL(rule4, rule6)
+	}
+
+	conn.lockflow(tcpconn.RemoteAddr(), func(e *tcpFlow) { e.conn = tcpconn })
+	conn.addHandle(handle, tcpconn.LocalAddr().(*net.TCPAddr).Port)
+	if !conn.writeOnly {
+		conn.waitHandshake(raddr)
+	}
+
+	// discard everything
+	if !conn.keepStream {
+		go io.Copy(ioutil.Discard, tcpconn)
+	}
+	return nil
+}
+
+// Listen acts like net.ListenTCP,
+// and returns a single packet-oriented connection
+func Listen(network, address string) (*TCPConn, error) {
+	var lc ListenConfig
+	return lc.Listen(network, address)
+}
+
+// Listen acts like the package-level Listen, with the options in lc applied.
+func (lc *ListenConfig) Listen(network, address string) (*TCPConn, error) {
+	// fields
+	conn := new(TCPConn)
+	conn.flowTable = make(map[string]*tcpFlow)
+	conn.die = make(chan struct{})
+	conn.chMessage = make(chan message)
+	conn.keepTTL = lc.KeepTTL
+	conn.keepStream = lc.KeepStream
+	conn.mark = lc.Mark
+	conn.logger = lc.Logger
+	conn.server = true
+	conn.rawOnly = lc.RawOnly
+	conn.readOnly = lc.Mode == ModeReadOnly
+	conn.writeOnly = lc.Mode == ModeWriteOnly
+	if lc.Mode != ModeReadWrite && lc.RawOnly {
+		return nil, errMode
+	}
+	conn.flags = uint32(defaultFlags)
+	conn.wscale = defaultWindowScale
+	conn.writeSem.Store(make(chan struct{}, defaultWriteConcurrency))
+	conn.opts = gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+
+	// source allowlist
+	if len(lc.AllowedHosts) > 0 {
+		allowed, err := resolveHosts(lc.AllowedHosts)
+		if err != nil {
+			return nil, err
+		}
+		conn.allowed = allowed
+		conn.allowProgram = allowlistProgram(allowed)
+	}
+
+	// resolve address
+	laddr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if lc.RawOnly || conn.readOnly {
+		if laddr.Port == 0 {
+			return nil, errPortRequired
+		}
+		conn.laddr = laddr // capture may answer SYNs as soon as the handles are open
+	}
+
+	if !conn.writeOnly {
+		conn.captureWorkers = 1
+	}
+
+	// AF_INET
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	if laddr.IP == nil || laddr.IP.IsUnspecified() { // if address is not specified, capture on all ifaces
+		if lc.Interfaces != "" {
+			if ifaces, err = matchInterfaces(ifaces, lc.Interfaces); err != nil {
+				return nil, err
+			}
+		}
+
+		var ips []net.IP
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp == 0 { // nothing to capture on a down interface
+				continue
+			}
+			if addrs, err := iface.Addrs(); err == nil {
+				for _, addr := range addrs {
+					if ipaddr, ok := addr.(*net.IPNet); ok && matchFamily(network, ipaddr.IP) {
+						ips = append(ips, ipaddr.IP)
+					}
+				}
+			}
+		}
+
+		// an address listed on several interfaces is captured on once, as every
+		// handle bound to it would see the same packets
+		var lasterr error
+		for _, ip := range uniqueIPs(ips) {
+			if handle, err := listenIP(network, ip, lc.Mark, lc.FreeBind); err == nil {
+				conn.addHandle(handle, laddr.Port)
+			} else {
+				lasterr = err
+			}
+		}
+		if len(conn.Handles()) == 0 {
+			if lasterr == nil {
+				lasterr = errNoAddress
+			}
+			return nil, lasterr
+		}
+	} else {
+		if handle, err := listenIP(network, laddr.IP, lc.Mark, lc.FreeBind); err == nil {
+			conn.addHandle(handle, laddr.Port)
+		} else {
+			return nil, err
+		}
+	}
+
+	// another process owns the port and sends
+	if conn.readOnly {
+		go conn.cleaner()
+		return conn, nil
+	}
+
+	// no listening socket, the kernel must not reset the crafted handshakes
+	if lc.RawOnly {
+		go conn.cleaner()
+		rule := []string{"-p", "tcp", "--tcp-flags", "RST", "RST", "--sport", fmt.Sprint(laddr.Port), "-j", "DROP"}
+		conn.dropTTL(rule, rule)
+		return conn, nil
+	}
+
+	// start listening, a wildcard address on "tcp" accepts both IPv4 and IPv6 peers
+	lcfg := net.ListenConfig{Control: chainControl(dualStack(network), markControl(lc.Mark), reusePortControl(lc.ReusePort), freeBindControl(lc.FreeBind), lc.Control)}
+	ln, err := lcfg.Listen(context.Background(), network, laddr.String())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	l := ln.(*net.TCPListener)
+	conn.listener = l
+	conn.laddr = l.Addr().(*net.TCPAddr)
+	if lc.Backlog > 0 {
+		if err := setBacklog(l, lc.Backlog); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	// start cleaner
+	go conn.cleaner()
+
+	if !lc.KeepTTL {
+		// iptables drop packets marked with TTL = 1
+		// TODO: what if iptables is not available, the next hop will send back ICMP Time Exceeded,
+		// is this still an acceptable behavior?
+		rule4 := []string{"-m", "ttl", "--ttl-eq", "1", "-p", "tcp", "--sport", fmt.Sprint(laddr.Port), "-j", "DROP"}
+		rule6 := []string{"-m", "hl", "--hl-eq", "1", "-p", "tcp", "--sport", fmt.Sprint(laddr.Port), "-j", "DROP"}
+		conn.dropTTL(rule4, rule6)
+	}
+
+	// discard everything in original connection
+	maxAccepted := lc.MaxAccepted
+	if maxAccepted <= 0 {
+		maxAccepted = defaultMaxAccepted
+	}
+	drains := make(chan struct{}, maxAccepted)
+	go func() {
+		for {
+			tcpconn, err := l.AcceptTCP()
+			if err != nil {
+				return
+			}
+
+			// the handshake of a disallowed peer is completed by the kernel, don't drain it
+			if conn.allowed != nil && !conn.allowed[tcpconn.RemoteAddr().(*net.TCPAddr).IP.String()] {
+				tcpconn.Close()
+				continue
+			}
+
+			// bound the drains, an accept flood must not spawn goroutines without limit
+			if !conn.keepStream {
+				select {
+				case drains <- struct{}{}:
+				default:
+					conn.logf("tcpraw: refusing %v, %d accepted connections are drained", tcpconn.RemoteAddr(), maxAccepted)
+					tcpconn.Close()
+					continue
+				}
+			}
+
+			// if we cannot set TTL = 1, the kernel's packets would corrupt the flow, refuse it
+			if !lc.KeepTTL {
+				if err := setTTL(tcpconn, 1); err != nil {
+					conn.logf("tcpraw: refusing %v, cannot set TTL: %v", tcpconn.RemoteAddr(), err)
+					tcpconn.Close()
+					if !conn.keepStream {
+						<-drains
+					}
+					continue
+				}
+			}
+
+			// record net.Conn
+			var early []message
+			conn.lockflow(tcpconn.RemoteAddr(), func(e *tcpFlow) {
+				e.conn = tcpconn
+				early, e.early = e.early, nil
+			})
+
+			// data which arrived before the accept, without holding up the next one
+			if len(early) > 0 {
+				go func() {
+					for _, msg := range early {
+						if !conn.deliver(msg) {
+							return
+						}
+					}
+				}()
+			}
+
+			// discard everything
+			if !conn.keepStream {
+				go func() {
+					io.Copy(ioutil.Discard, tcpconn)
+					<-drains
+				}()
+			}
+		}
+	}()
+
+	return conn, nil
+}
+
+// setBacklog listens again on the socket of l with backlog, linux updates the queue length
+func setBacklog(l *net.TCPListener, backlog int) error {
+	raw, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var operr error
+	if err := raw.Control(func(fd uintptr) { operr = syscall.Listen(int(fd), backlog) }); err != nil {
+		return err
+	}
+	return operr
+}
+
+// dropTTL installs iptables rules dropping the outgoing packets matched by rule4 on IPv4
+// and rule6 on IPv6, unless they already exist, the rules are deleted on Close
+func (conn *TCPConn) dropTTL(rule4, rule6 []string) {
+	if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4); err == nil {
+		if exists, err := ipt.Exists("filter", "OUTPUT", rule4...); err == nil {
+			if !exists {
+				if err = ipt.Append("filter", "OUTPUT", rule4...); err == nil {
+					conn.iprules = append(conn.iprules, rule4)
+					conn.iptables = ipt
+				}
+			}
+		}
+	}
+	if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6); err == nil {
+		if exists, err := ipt.Exists("filter", "OUTPUT", rule6...); err == nil {
+			if !exists {
+				if err = ipt.Append("filter", "OUTPUT", rule6...); err == nil {
+					conn.ip6rules = append(conn.ip6rules, rule6)
+					conn.ip6tables = ipt
+				}
+			}
+		}
+	}
+}
+
+// checksumLayer returns the IP header the TCP checksum of a segment from src to dst
+// covers. The kernel builds the actual header of raw sockets, with the protocol of
+// the socket, so the protocol is always TCP whatever the captured packets carried.
+func checksumLayer(src, dst net.IP) gopacket.NetworkLayer {
+	if dst.To4() != nil {
+		return &layers.IPv4{Protocol: layers.IPProtocolTCP, SrcIP: src.To4(), DstIP: dst.To4()}
+	}
+	return &layers.IPv6{NextHeader: layers.IPProtocolTCP, SrcIP: src.To16(), DstIP: dst.To16()}
+}
+
+// transient reports whether a send failed for lack of buffers, and may succeed later
+func transient(err error) bool {
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	switch err {
+	case syscall.EAGAIN, syscall.ENOBUFS, syscall.ENOMEM:
+		return true
+	}
+	return false
+}
+
+// setFlags sets the flag bits of a TCP header to flags
+func setFlags(tcp *layers.TCP, flags TCPFlags) {
+	tcp.FIN = flags&FlagFIN != 0
+	tcp.SYN = flags&FlagSYN != 0
+	tcp.RST = flags&FlagRST != 0
+	tcp.PSH = flags&FlagPSH != 0
+	tcp.ACK = flags&FlagACK != 0
+	tcp.URG = flags&FlagURG != 0
+	tcp.ECE = flags&FlagECE != 0
+	tcp.CWR = flags&FlagCWR != 0
+	tcp.NS = flags&FlagNS != 0
+}
+
+// uniqueIPs returns ips without the duplicates, in their original order
+func uniqueIPs(ips []net.IP) []net.IP {
+	seen := make(map[string]bool)
+	var unique []net.IP
+	for _, ip := range ips {
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			unique = append(unique, ip)
+		}
+	}
+	return unique
+}
+
+// matchInterfaces returns the interfaces whose names match the glob pattern
+func matchInterfaces(ifaces []net.Interface, pattern string) ([]net.Interface, error) {
+	var matched []net.Interface
+	for _, iface := range ifaces {
+		ok, err := path.Match(pattern, iface.Name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, iface)
+		}
+	}
+
+	if len(matched) == 0 {
+		return nil, errNoInterface
+	}
+	return matched, nil
+}
+
+// ipNetwork returns the raw IP network for TCP with the same address family as network
+func ipNetwork(network string) string {
+	switch network {
+	case "tcp4":
+		return "ip4:tcp"
+	case "tcp6":
+		return "ip6:tcp"
+	}
+	return "ip:tcp"
+}
+
+// ipPayload returns the TCP segment of a packet read by ReadMsgIP, which leaves the
+// IPv4 header in front, and the TTL or hop limit of the packet, or 0 if unknown
+func ipPayload(b, oob []byte, from net.IP) ([]byte, uint8) {
+	if from.To4() != nil {
+		if len(b) < 20 {
+			return b, 0
+		}
+		l := int(b[0]&0x0f) << 2
+		if l < 20 || l > len(b) {
+			return b, 0
+		}
+		return b[l:], b[8]
+	}
+
+	// the hop limit comes in a control message with IPV6_RECVHOPLIMIT
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return b, 0
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_HOPLIMIT && len(m.Data) >= 4 {
+			return b, uint8(*(*int32)(unsafe.Pointer(&m.Data[0])))
+		}
+	}
+	return b, 0
+}
+
+// delivered reports whether a segment of n bytes at seq was delivered lately, e.g.
+// seen by another handle capturing the same traffic, and remembers it otherwise
+func (e *tcpFlow) delivered(seq, n uint32) bool {
+	r := seqRange{seq, n}
+	for _, d := range e.recent {
+		if d == r {
+			return true
+		}
+	}
+	e.recent[e.recentPos] = r
+	e.recentPos = (e.recentPos + 1) % recentSegments
+	return false
+}
+
+// trackTimestamp records the timestamp value of a segment from the peer, to echo it
+func (e *tcpFlow) trackTimestamp(tcp *layers.TCP) {
+	for _, opt := range tcp.Options {
+		if opt.OptionType == layers.TCPOptionKindTimestamps && len(opt.OptionData) == 8 {
+			e.tsRecent = binary.BigEndian.Uint32(opt.OptionData)
+			e.peerTS = true
+			return
+		}
+	}
+}
+
+// profileOptions builds the options of the next segment of the flow with prof, the
+// SYN options in the order of the profile, then timestamps on the other segments
+// once the peer sends them, rand picks the offset of the timestamp clock
+func (e *tcpFlow) profileOptions(prof *osProfile, rand func() uint32, mss int32, shift uint8, dst net.IP) []layers.TCPOption {
+	var tsval uint32
+	if prof.tsHz > 0 {
+		if !e.tsSet {
+			e.tsOffset = rand()
+			e.tsSet = true
+		}
+		tsval = e.tsOffset + uint32(time.Now().UnixNano()/int64(time.Second/time.Duration(prof.tsHz)))
+	}
+	timestamps := func() layers.TCPOption {
+		opt := layers.TCPOption{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: make([]byte, 8)}
+		binary.BigEndian.PutUint32(opt.OptionData, tsval)
+		if e.peerTS {
+			binary.BigEndian.PutUint32(opt.OptionData[4:], e.tsRecent)
+		}
+		return opt
+	}
+
+	var opts []layers.TCPOption
+	if !e.tcpHeader.SYN {
+		if prof.tsHz > 0 && e.peerTS {
+			opts = append(opts,
+				layers.TCPOption{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+				layers.TCPOption{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+				timestamps())
+		}
+		return opts
+	}
+
+	if mss <= 0 { // what the OS derives from an ethernet MTU
+		mss = 1460
+		if dst.To4() == nil {
+			mss = 1440
 		}
-		if conn.ip6tables != nil {
-			conn.ip6tables.Delete("filter", "OUTPUT", conn.ip6rule...)
+	}
+	for _, kind := range prof.synOptions {
+		switch kind {
+		case layers.TCPOptionKindMSS:
+			opt := layers.TCPOption{OptionType: kind, OptionLength: 4, OptionData: make([]byte, 2)}
+			binary.BigEndian.PutUint16(opt.OptionData, uint16(mss))
+			opts = append(opts, opt)
+		case layers.TCPOptionKindSACKPermitted:
+			opts = append(opts, layers.TCPOption{OptionType: kind, OptionLength: 2})
+		case layers.TCPOptionKindTimestamps:
+			opts = append(opts, timestamps())
+		case layers.TCPOptionKindNop:
+			opts = append(opts, layers.TCPOption{OptionType: kind, OptionLength: 1})
+		case layers.TCPOptionKindWindowScale:
+			opts = append(opts, layers.TCPOption{OptionType: kind, OptionLength: 3, OptionData: []byte{shift}})
 		}
-	})
-	return err
+	}
+	return opts
 }
 
-// LocalAddr returns the local network address.
-func (conn *TCPConn) LocalAddr() net.Addr {
-	if conn.tcpconn != nil {
-		return conn.tcpconn.LocalAddr()
-	} else if conn.listener != nil {
-		return conn.listener.Addr()
+// windowScale returns the window scale shift in the options of a SYN, or 0 without one
+func windowScale(tcp *layers.TCP) uint8 {
+	for _, opt := range tcp.Options {
+		if opt.OptionType == layers.TCPOptionKindWindowScale && len(opt.OptionData) == 1 {
+			if opt.OptionData[0] > 14 { // RFC 7323
+				return 14
+			}
+			return opt.OptionData[0]
+		}
 	}
-	return nil
+	return 0
 }
 
-// SetDeadline implements the Conn SetDeadline method.
-func (conn *TCPConn) SetDeadline(t time.Time) error {
-	if err := conn.SetReadDeadline(t); err != nil {
-		return err
-	}
-	if err := conn.SetWriteDeadline(t); err != nil {
-		return err
+// getFlags returns the flags set in a TCP header
+func getFlags(tcp *layers.TCP) (flags TCPFlags) {
+	bits := []bool{tcp.FIN, tcp.SYN, tcp.RST, tcp.PSH, tcp.ACK, tcp.URG, tcp.ECE, tcp.CWR, tcp.NS}
+	for k, set := range bits { // in the order of the TCPFlags constants
+		if set {
+			flags |= 1 << uint(k)
+		}
 	}
-	return nil
+	return
 }
 
-// SetReadDeadline implements the Conn SetReadDeadline method.
-func (conn *TCPConn) SetReadDeadline(t time.Time) error {
-	conn.readDeadline.Store(t)
-	return nil
+// matchFamily reports whether ip belongs to the address family pinned by network
+func matchFamily(network string, ip net.IP) bool {
+	switch network {
+	case "tcp4":
+		return ip.To4() != nil
+	case "tcp6":
+		return ip.To4() == nil
+	}
+	return true
 }
 
-// SetWriteDeadline implements the Conn SetWriteDeadline method.
-func (conn *TCPConn) SetWriteDeadline(t time.Time) error {
-	conn.writeDeadline.Store(t)
-	return nil
-}
+// controlFunc is a socket control function as in net.Dialer and net.ListenConfig
+type controlFunc func(network, address string, c syscall.RawConn) error
 
-// SetDSCP sets the 6bit DSCP field in IPv4 header, or 8bit Traffic Class in IPv6 header.
-func (conn *TCPConn) SetDSCP(dscp int) error {
-	for k := range conn.handles {
-		if err := setDSCP(conn.handles[k], dscp); err != nil {
-			return err
+// chainControl returns a socket control function calling the non-nil fns in order
+func chainControl(fns ...controlFunc) controlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		for _, fn := range fns {
+			if fn != nil {
+				if err := fn(network, address, c); err != nil {
+					return err
+				}
+			}
 		}
+		return nil
 	}
-	return nil
 }
 
-// SetReadBuffer sets the size of the operating system's receive buffer associated with the connection.
-func (conn *TCPConn) SetReadBuffer(bytes int) error {
-	var err error
-	for k := range conn.handles {
-		if err := conn.handles[k].SetReadBuffer(bytes); err != nil {
-			return err
-		}
+// markControl returns a socket control function setting SO_MARK, or nil if mark is 0
+func markControl(mark int) controlFunc {
+	if mark == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return setMark(c, mark)
 	}
-	return err
 }
 
-// SetWriteBuffer sets the size of the operating system's transmit buffer associated with the connection.
-func (conn *TCPConn) SetWriteBuffer(bytes int) error {
-	var err error
-	for k := range conn.handles {
-		if err := conn.handles[k].SetWriteBuffer(bytes); err != nil {
-			return err
+// reusePortControl returns a socket control function setting SO_REUSEPORT, or nil if not reuse
+func reusePortControl(reuse bool) controlFunc {
+	if !reuse {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReuseport, 1)
+		}); cerr != nil {
+			return cerr
 		}
+		return err
 	}
-	return err
 }
 
-// Dial connects to the remote TCP port,
-// and returns a single packet-oriented connection
-func Dial(network, address string) (*TCPConn, error) {
-	// remote address resolve
-	raddr, err := net.ResolveTCPAddr(network, address)
-	if err != nil {
-		return nil, err
+// freeBindControl returns a socket control function setting IP_FREEBIND, or IPV6_FREEBIND
+// on an IPv6 socket, or nil if not free
+func freeBindControl(free bool) controlFunc {
+	if !free {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			var domain int
+			if domain, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_DOMAIN); err != nil {
+				return
+			}
+			if domain == syscall.AF_INET6 {
+				err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6Freebind, 1)
+			} else {
+				err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_FREEBIND, 1)
+			}
+		}); cerr != nil {
+			return cerr
+		}
+		return err
 	}
+}
 
-	// AF_INET
-	handle, err := net.DialIP("ip:tcp", nil, &net.IPAddr{IP: raddr.IP})
+// dialIP opens a raw handle to ip in the family of a TCP network, with SO_MARK set to mark,
+// and IP_FREEBIND if freebind, so src needs not be configured yet
+func dialIP(network string, src, ip net.IP, mark int, freebind bool) (*net.IPConn, error) {
+	dialer := net.Dialer{Control: freeBindControl(freebind)}
+	if src != nil {
+		dialer.LocalAddr = &net.IPAddr{IP: src}
+	}
+	c, err := dialer.Dial(ipNetwork(network), ip.String())
 	if err != nil {
 		return nil, err
 	}
-
-	// create an established tcp connection
-	// will hack this tcp connection for packet transmission
-	tcpconn, err := net.DialTCP(network, nil, raddr)
-	if err != nil {
+	handle := c.(*net.IPConn)
+	if err := markConn(handle, mark); err != nil {
+		handle.Close()
 		return nil, err
 	}
-
-	// fields
-	conn := new(TCPConn)
-	conn.die = make(chan struct{})
-	conn.flowTable = make(map[string]*tcpFlow)
-	conn.tcpconn = tcpconn
-	conn.chMessage = make(chan message)
-	conn.lockflow(tcpconn.RemoteAddr(), func(e *tcpFlow) { e.conn = tcpconn })
-	conn.handles = append(conn.handles, handle)
-	conn.opts = gopacket.SerializeOptions{
-		FixLengths:       true,
-		ComputeChecksums: true,
+	if err := recvHopLimit(handle, ip); err != nil {
+		handle.Close()
+		return nil, err
 	}
-	go conn.captureFlow(handle, tcpconn.LocalAddr().(*net.TCPAddr).Port)
-	go conn.cleaner()
+	return handle, nil
+}
 
-	// iptables
-	err = setTTL(tcpconn, 1)
+// listenIP opens a raw handle on ip in the family of a TCP network, with SO_MARK set to mark,
+// and IP_FREEBIND if freebind
+func listenIP(network string, ip net.IP, mark int, freebind bool) (*net.IPConn, error) {
+	lcfg := net.ListenConfig{Control: freeBindControl(freebind)}
+	c, err := lcfg.ListenPacket(context.Background(), ipNetwork(network), ip.String())
 	if err != nil {
 		return nil, err
 	}
-
-	if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4); err == nil {
-		rule := []string{"-m", "ttl", "--ttl-eq", "1", "-p", "tcp", "-d", raddr.IP.String(), "--dport", fmt.Sprint(raddr.Port), "-j", "DROP"}
-		if exists, err := ipt.Exists("filter", "OUTPUT", rule...); err == nil {
-			if !exists {
-				if err = ipt.Append("filter", "OUTPUT", rule...); err == nil {
-					conn.iprule = rule
-					conn.iptables = ipt
-				}
-			}
-		}
+	handle := c.(*net.IPConn)
+	if err := markConn(handle, mark); err != nil {
+		handle.Close()
+		return nil, err
 	}
-	if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6); err == nil {
-		rule := []string{"-m", "hl", "--hl-eq", "1", "-p", "tcp", "-d", raddr.IP.String(), "--dport", fmt.Sprint(raddr.Port), "-j", "DROP"}
-		if exists, err := ipt.Exists("filter", "OUTPUT", rule...); err == nil {
-			if !exists {
-				if err = ipt.Append("filter", "OUTPUT", rule...); err == nil {
-					conn.ip6rule = rule
-					conn.ip6tables = ipt
-				}
-			}
-		}
+	if err := recvHopLimit(handle, ip); err != nil {
+		handle.Close()
+		return nil, err
 	}
-
-	// discard everything
-	go io.Copy(ioutil.Discard, tcpconn)
-
-	return conn, nil
+	return handle, nil
 }
 
-// Listen acts like net.ListenTCP,
-// and returns a single packet-oriented connection
-func Listen(network, address string) (*TCPConn, error) {
-	// fields
-	conn := new(TCPConn)
-	conn.flowTable = make(map[string]*tcpFlow)
-	conn.die = make(chan struct{})
-	conn.chMessage = make(chan message)
-	conn.opts = gopacket.SerializeOptions{
-		FixLengths:       true,
-		ComputeChecksums: true,
+// dialTCP connects a system TCP connection to raddr, with SO_MARK set to mark
+// and the caller's control run afterwards
+func dialTCP(network string, src net.IP, raddr *net.TCPAddr, mark int, control controlFunc) (*net.TCPConn, error) {
+	dialer := net.Dialer{Control: chainControl(markControl(mark), control)}
+	if src != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: src}
 	}
-
-	// resolve address
-	laddr, err := net.ResolveTCPAddr(network, address)
+	conn, err := dialer.Dial(network, raddr.String())
 	if err != nil {
 		return nil, err
 	}
+	return conn.(*net.TCPConn), nil
+}
 
-	// AF_INET
-	ifaces, err := net.Interfaces()
+// checkSourceIP makes sure src is an address of the interface the kernel routes to dst through
+func checkSourceIP(src, dst net.IP) error {
+	udpconn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst, Port: 9})
 	if err != nil {
-		return nil, err
+		return err
 	}
+	egress := udpconn.LocalAddr().(*net.UDPAddr).IP
+	udpconn.Close()
 
-	if laddr.IP == nil || laddr.IP.IsUnspecified() { // if address is not specified, capture on all ifaces
-		var lasterr error
-		for _, iface := range ifaces {
-			if addrs, err := iface.Addrs(); err == nil {
-				for _, addr := range addrs {
-					if ipaddr, ok := addr.(*net.IPNet); ok {
-						if handle, err := net.ListenIP("ip:tcp", &net.IPAddr{IP: ipaddr.IP}); err == nil {
-							conn.handles = append(conn.handles, handle)
-							go conn.captureFlow(handle, laddr.Port)
-						} else {
-							lasterr = err
-						}
-					}
-				}
-			}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
 		}
-		if len(conn.handles) == 0 {
-			return nil, lasterr
+		var hasEgress, hasSrc bool
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				hasEgress = hasEgress || ipnet.IP.Equal(egress)
+				hasSrc = hasSrc || ipnet.IP.Equal(src)
+			}
 		}
-	} else {
-		if handle, err := net.ListenIP("ip:tcp", &net.IPAddr{IP: laddr.IP}); err == nil {
-			conn.handles = append(conn.handles, handle)
-			go conn.captureFlow(handle, laddr.Port)
-		} else {
-			return nil, err
+		if hasEgress {
+			if hasSrc {
+				return nil
+			}
+			return errSourceIP
 		}
 	}
+	return errSourceIP
+}
 
-	// start listening
-	l, err := net.ListenTCP(network, laddr)
+// recvHopLimit sets IPV6_RECVHOPLIMIT on an IPv6 handle opened for ip, IPv4 handles
+// read the TTL from the IP header
+func recvHopLimit(c *net.IPConn, ip net.IP) error {
+	if ip.To4() != nil {
+		return nil
+	}
+	raw, err := c.SyscallConn()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	var operr error
+	if err := raw.Control(func(fd uintptr) {
+		operr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVHOPLIMIT, 1)
+	}); err != nil {
+		return err
+	}
+	return operr
+}
 
-	conn.listener = l
-
-	// start cleaner
-	go conn.cleaner()
-
-	// iptables drop packets marked with TTL = 1
-	// TODO: what if iptables is not available, the next hop will send back ICMP Time Exceeded,
-	// is this still an acceptable behavior?
-	if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4); err == nil {
-		rule := []string{"-m", "ttl", "--ttl-eq", "1", "-p", "tcp", "--sport", fmt.Sprint(laddr.Port), "-j", "DROP"}
-		if exists, err := ipt.Exists("filter", "OUTPUT", rule...); err == nil {
-			if !exists {
-				if err = ipt.Append("filter", "OUTPUT", rule...); err == nil {
-					conn.iprule = rule
-					conn.iptables = ipt
-				}
-			}
-		}
+// markConn sets SO_MARK on a socket, unless mark is 0
+func markConn(c syscall.Conn, mark int) error {
+	if mark == 0 {
+		return nil
 	}
-	if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6); err == nil {
-		rule := []string{"-m", "hl", "--hl-eq", "1", "-p", "tcp", "--sport", fmt.Sprint(laddr.Port), "-j", "DROP"}
-		if exists, err := ipt.Exists("filter", "OUTPUT", rule...); err == nil {
-			if !exists {
-				if err = ipt.Append("filter", "OUTPUT", rule...); err == nil {
-					conn.ip6rule = rule
-					conn.ip6tables = ipt
-				}
-			}
-		}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
 	}
+	return setMark(raw, mark)
+}
 
-	// discard everything in original connection
-	go func() {
-		for {
-			tcpconn, err := l.AcceptTCP()
-			if err != nil {
-				return
-			}
+// setMark sets SO_MARK on a raw connection
+func setMark(raw syscall.RawConn, mark int) error {
+	var err error
+	if cerr := raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
 
-			// if we cannot set TTL = 1, the only thing reasonable is panic
-			if err := setTTL(tcpconn, 1); err != nil {
-				panic(err)
-			}
+// dualStack returns a socket control function clearing IPV6_V6ONLY on the
+// IPv6 sockets of a "tcp" listener, so IPv4 peers arrive as IPv4-mapped addresses
+func dualStack(network string) controlFunc {
+	return func(ctrlNetwork, address string, c syscall.RawConn) error {
+		if network != "tcp" || ctrlNetwork != "tcp6" {
+			return nil
+		}
 
-			// record net.Conn
-			conn.lockflow(tcpconn.RemoteAddr(), func(e *tcpFlow) { e.conn = tcpconn })
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
 
-			// discard everything
-			go io.Copy(ioutil.Discard, tcpconn)
+// resolveHosts resolves hosts to the set of their IP addresses
+func resolveHosts(hosts []string) (map[string]bool, error) {
+	ips := make(map[string]bool)
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			ips[ip.String()] = true
+			continue
 		}
-	}()
 
-	return conn, nil
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range addrs {
+			ips[ip.String()] = true
+		}
+	}
+	return ips, nil
 }
 
 // setTTL sets the Time-To-Live field on a given connection
@@ -586,6 +3838,103 @@ func setTTL(c *net.TCPConn, ttl int) error {
 	return err
 }
 
+// setHopLimit sets the TTL or hop limit of the packets sent on a handle, -1 restores
+// the kernel's default
+func setHopLimit(c *net.IPConn, ttl int) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var operr error
+	if err := raw.Control(func(fd uintptr) {
+		var domain int
+		if domain, operr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_DOMAIN); operr != nil {
+			return
+		}
+		if domain == syscall.AF_INET6 {
+			operr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+		} else {
+			operr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+		}
+	}); err != nil {
+		return err
+	}
+	return operr
+}
+
+// attachFilter attaches a classic BPF program to a handle, or detaches it if filter is nil
+func attachFilter(c *net.IPConn, filter []bpf.RawInstruction) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	if filter == nil {
+		raw.Control(func(fd uintptr) {
+			err = syscall.DetachLsf(int(fd))
+		})
+		if err == syscall.ENOENT { // nothing attached
+			err = nil
+		}
+		return err
+	}
+
+	prog := make([]syscall.SockFilter, len(filter))
+	for k, ins := range filter {
+		prog[k] = syscall.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	raw.Control(func(fd uintptr) {
+		err = syscall.AttachLsf(int(fd), prog)
+	})
+	return err
+}
+
+// attachEBPF attaches the eBPF program fd to a handle
+func attachEBPF(c *net.IPConn, fd int) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if cerr := raw.Control(func(sock uintptr) {
+		err = syscall.SetsockoptInt(int(sock), syscall.SOL_SOCKET, soAttachBPF, fd)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// setMSS sets the maximum segment size advertised by the connections a listener accepts
+func setMSS(l *net.TCPListener, mss int) error {
+	raw, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, mss)
+	})
+	return err
+}
+
+// socketDrops returns the number of packets the kernel dropped on a handle
+func socketDrops(c *net.IPConn) (uint64, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var meminfo [skMeminfoVars]uint32
+	raw.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(meminfo))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_SOCKET, soMeminfo,
+			uintptr(unsafe.Pointer(&meminfo[0])), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			err = errno
+		}
+	})
+	return uint64(meminfo[skMeminfoDrops]), err
+}
+
 // setDSCP sets the 6bit DSCP field in IPv4 header, or 8bit Traffic Class in IPv6 header.
 func setDSCP(c *net.IPConn, dscp int) error {
 	raw, err := c.SyscallConn()
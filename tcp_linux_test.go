@@ -0,0 +1,1764 @@
+// +build linux
+
+package tcpraw
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+func TestDialSpeakFirst(t *testing.T) {
+	// the echo server only speaks once it has received, the flow is ready from the handshake
+	conn, err := Dial("tcp", portRemotePacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr, err := net.ResolveTCPAddr("tcp", portRemotePacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ready bool
+	conn.lockflow(addr, func(e *tcpFlow) { ready = e.ready && e.handle != nil })
+	if !ready {
+		t.Fatal("flow not ready after Dial")
+	}
+
+	if _, err := conn.WriteTo([]byte("first"), addr); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	if n, _, err := conn.ReadFrom(buf); err != nil || string(buf[:n]) != "first" {
+		t.Fatal("unexpected echo:", string(buf[:n]), err)
+	}
+}
+
+func TestDialHandshakeTimeout(t *testing.T) {
+	// the flow is ready once Dial returns
+	conn, err := Dial("tcp", testPortStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := conn.Peers()
+	conn.Close()
+	if len(peers) != 1 || peers[0].String() != testPortStream {
+		t.Fatal("peers:", peers)
+	}
+
+	// or not waited for
+	d := Dialer{HandshakeTimeout: -1}
+	if conn, err = d.Dial("tcp", testPortStream); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestDialSourceIP(t *testing.T) {
+	d := Dialer{SourceIP: net.IPv4(127, 0, 0, 1)}
+	conn, err := d.Dial("tcp", testPortStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(d.SourceIP) {
+		t.Fatal("local address:", ip)
+	}
+	conn.Close()
+
+	// an address of no interface is refused
+	d.SourceIP = net.IPv4(192, 0, 2, 1)
+	if _, err := d.Dial("tcp", testPortStream); err != errSourceIP {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestControl(t *testing.T) {
+	var calls int32
+	control := func(network, address string, c syscall.RawConn) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	}
+	lc := ListenConfig{Control: control}
+	ln, err := lc.Listen("tcp", "127.0.0.1:3470")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	d := Dialer{Control: control}
+	conn, err := d.Dial("tcp", "127.0.0.1:3470")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatal("control called", n, "times")
+	}
+
+	// an error from the hook fails the dial
+	d.Control = func(network, address string, c syscall.RawConn) error { return errNoHandle }
+	if _, err := d.Dial("tcp", "127.0.0.1:3470"); err == nil {
+		t.Fatal("dial succeeded")
+	}
+}
+
+func TestFreeBind(t *testing.T) {
+	// an address of no interface, as a VIP before it floats in
+	var lc ListenConfig
+	if _, err := lc.Listen("tcp", "192.0.2.1:3471"); err == nil {
+		t.Fatal("listening on an address not configured")
+	}
+	lc.FreeBind = true
+	ln, err := lc.Listen("tcp", "192.0.2.1:3471")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if ip := ln.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatal("local address:", ip)
+	}
+	for _, handle := range ln.Handles() {
+		if ip := handle.LocalAddr().(*net.IPAddr).IP; !ip.Equal(net.IPv4(192, 0, 2, 1)) {
+			t.Fatal("capturing on", ip)
+		}
+	}
+}
+
+func TestSplitModes(t *testing.T) {
+	if _, err := (&Dialer{Mode: ModeReadOnly}).Dial("tcp", "127.0.0.1:3476"); err != errMode {
+		t.Fatal("unexpected error:", err)
+	}
+
+	server, err := Listen("tcp", "127.0.0.1:3476")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// one process writes, another reads on its port
+	writer, err := (&Dialer{Mode: ModeWriteOnly}).Dial("tcp", "127.0.0.1:3476")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	if err := writer.SetCaptureConcurrency(2); err != errWriteOnly {
+		t.Fatal("unexpected error:", err)
+	}
+	lc := ListenConfig{Mode: ModeReadOnly}
+	reader, err := lc.Listen("tcp", writer.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// the reader learns the flow from the server's segments
+	buf := make([]byte, 1500)
+	for try := 0; ; try++ {
+		if try == 20 {
+			t.Fatal("the reader captured nothing")
+		}
+		if _, err := server.WriteTo([]byte("hello"), writer.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		reader.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, addr, err := reader.ReadFrom(buf)
+		if err == nil {
+			if string(buf[:n]) != "hello" || addr.String() != "127.0.0.1:3476" {
+				t.Fatalf("unexpected packet %q from %v", buf[:n], addr)
+			}
+			break
+		}
+	}
+	if _, err := reader.WriteTo([]byte("hello"), server.LocalAddr()); err != errReadOnly {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// and hands it over to the writer
+	flows, err := reader.ExportFlows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.ImportFlows(flows); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteTo([]byte("world"), server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := server.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("server read %q: %v", buf[:n], err)
+	}
+}
+
+func TestAllowlistProgram(t *testing.T) {
+	allowed := map[string]bool{"192.0.2.1": true, "192.0.2.2": true, "::1": true}
+	conn := &TCPConn{allowProgram: allowlistProgram(allowed)}
+	handle, err := net.ListenIP("ip4:tcp", &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+
+	user, _ := bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: 7}})
+	for _, filter := range [][]bpf.RawInstruction{nil, user} {
+		insts, _ := bpf.Disassemble(conn.program(handle, filter))
+		vm, err := bpf.NewVM(insts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for src, accepted := range map[string]bool{"192.0.2.1": true, "192.0.2.2": true, "192.0.2.3": false} {
+			header := make([]byte, 40)
+			copy(header[12:], net.ParseIP(src).To4())
+			n, err := vm.Run(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accepted != (n > 0) || (accepted && filter != nil && n != 7) {
+				t.Fatal(src, "filtered to", n)
+			}
+		}
+	}
+}
+
+func TestListenAllowedHosts(t *testing.T) {
+	lc := ListenConfig{AllowedHosts: []string{"192.0.2.1"}}
+	ln, err := lc.Listen("tcp", "127.0.0.1:3478")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if filters := ln.BPFFilters(); len(filters) != 1 || !strings.HasPrefix(filters[0], "ld [12]") {
+		t.Fatal("BPFFilters:", filters)
+	}
+
+	// the kernel completes the handshake, the connection is closed at once
+	c, err := net.Dial("tcp", "127.0.0.1:3478")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestListenLoopback(t *testing.T) {
+	// lo on linux, lo0 elsewhere
+	lc := ListenConfig{Interfaces: "lo*"}
+	ln, err := lc.Listen("tcp", "[::]:3458")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	for _, handle := range ln.Handles() {
+		if ip := handle.LocalAddr().(*net.IPAddr).IP; !ip.IsLoopback() || !ln.IsLoopback(handle) {
+			t.Fatal("capturing on", ip)
+		}
+	}
+
+	conn, err := Dial("tcp", "127.0.0.1:3458")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestPacketConn(t *testing.T) {
+	conn, err := Dial("tcp", portRemotePacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pc net.PacketConn = conn
+
+	if pc.LocalAddr() == nil {
+		t.Fatal("nil LocalAddr")
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", portRemotePacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// deadlines in the past fail immediately with a timeout
+	pc.SetDeadline(time.Now().Add(-time.Second))
+	buf := make([]byte, 1024)
+	if _, _, err := pc.ReadFrom(buf); err == nil {
+		t.Fatal("ReadFrom: expected timeout")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal("ReadFrom:", err)
+	}
+	if _, err := pc.WriteTo([]byte("abc"), addr); err == nil {
+		t.Fatal("WriteTo: expected timeout")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal("WriteTo:", err)
+	}
+
+	// Close is idempotent
+	if conn.IsClosed() {
+		t.Fatal("closed before Close")
+	}
+	if err := pc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !conn.IsClosed() {
+		t.Fatal("not closed after Close")
+	}
+	pc.SetDeadline(time.Time{})
+	if _, _, err := pc.ReadFrom(buf); err != ErrClosed {
+		t.Fatal("ReadFrom after Close:", err)
+	}
+}
+
+func TestWait(t *testing.T) {
+	conn, err := Dial("tcp", portRemotePacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetCaptureConcurrency(4)
+	conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("capture goroutines still running after Close")
+	}
+}
+
+func TestSettings(t *testing.T) {
+	conn, err := Dial("tcp", portRemotePacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDSCP(46); err != nil {
+		log.Fatal("SetDSCP:", err)
+	}
+	if err := conn.SetReadBuffer(4096); err != nil {
+		log.Fatal("SetReaderBuffer:", err)
+	}
+	if err := conn.SetWriteBuffer(4096); err != nil {
+		log.Fatal("SetWriteBuffer:", err)
+	}
+	filter, err := bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: 0xffff}})
+	if err != nil {
+		log.Fatal("Assemble:", err)
+	}
+	if err := conn.SetBPFFilter(filter); err != nil {
+		log.Fatal("SetBPFFilter:", err)
+	}
+	if filters := conn.BPFFilters(); len(filters) != 1 || filters[0] != "ret #65535" {
+		log.Fatal("BPFFilters:", filters)
+	}
+	if err := conn.SetBPFFilter(nil); err != nil {
+		log.Fatal("SetBPFFilter:", err)
+	}
+	if _, err := conn.CaptureStats(); err != nil {
+		log.Fatal("CaptureStats:", err)
+	}
+	if err := conn.SetOSProfile(OSProfileWindows10); err != nil {
+		log.Fatal("SetOSProfile:", err)
+	}
+	if err := conn.SetOSProfile(OSProfileNone); err != nil {
+		log.Fatal("SetOSProfile:", err)
+	}
+}
+
+func TestEBPFFilter(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("no bpf syscall number for", runtime.GOARCH)
+	}
+	fd, err := loadSocketFilter(0xffff)
+	if err != nil {
+		t.Skip("cannot load an eBPF program:", err)
+	}
+	defer syscall.Close(fd)
+
+	conn, err := Dial("tcp", portRemotePacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetEBPFFilter(fd); err != nil {
+		t.Fatal(err)
+	}
+	if filters := conn.BPFFilters(); len(filters) != 1 || filters[0] != fmt.Sprint("ebpf fd ", fd) {
+		t.Fatal("BPFFilters:", filters)
+	}
+
+	// a file which is no program is refused, and the program stays
+	if err := conn.SetEBPFFilter(0); err == nil {
+		t.Fatal("attached stdin")
+	}
+	if filters := conn.BPFFilters(); len(filters) != 1 || filters[0] != fmt.Sprint("ebpf fd ", fd) {
+		t.Fatal("BPFFilters:", filters)
+	}
+	if err := conn.SetEBPFFilter(-1); err != nil {
+		t.Fatal(err)
+	}
+	if filters := conn.BPFFilters(); len(filters) != 1 || filters[0] != "" {
+		t.Fatal("BPFFilters:", filters)
+	}
+}
+
+func TestTrackFirstDataSegment(t *testing.T) {
+	// the handshake was missed, the first segment seen carries data
+	var e tcpFlow
+	e.track(&layers.TCP{Seq: 1000, Ack: 500, ACK: true, PSH: true, BaseLayer: layers.BaseLayer{Payload: []byte("abc")}}, time.Now())
+	if e.ack != 1003 {
+		t.Fatal("ack after first data segment:", e.ack)
+	}
+	if e.seq != 500 {
+		t.Fatal("seq after first data segment:", e.seq)
+	}
+
+	// an out of order segment doesn't advance ack
+	e.track(&layers.TCP{Seq: 2000, Ack: 500, ACK: true, PSH: true, BaseLayer: layers.BaseLayer{Payload: []byte("xyz")}}, time.Now())
+	if e.ack != 1003 {
+		t.Fatal("ack after out of order segment:", e.ack)
+	}
+}
+
+func TestTrackHandshake(t *testing.T) {
+	// a server capturing the peer's side of the three-way handshake, the SYN-ACK is
+	// sent by the kernel and not captured
+	var e tcpFlow
+	e.track(&layers.TCP{Seq: 1000, SYN: true}, time.Now())
+	e.track(&layers.TCP{Seq: 1001, Ack: 5001, ACK: true}, time.Now())
+	if e.ack != 1001 {
+		t.Fatal("ack after handshake:", e.ack)
+	}
+
+	e.track(&layers.TCP{Seq: 1001, Ack: 5001, ACK: true, PSH: true, BaseLayer: layers.BaseLayer{Payload: []byte("abc")}}, time.Now())
+	if e.ack != 1004 {
+		t.Fatal("ack after first data segment:", e.ack)
+	}
+	if e.seq != 5001 {
+		t.Fatal("seq after first data segment:", e.seq)
+	}
+}
+
+func TestDupAcks(t *testing.T) {
+	var e tcpFlow
+	e.track(&layers.TCP{Seq: 1000, Ack: 5000, ACK: true}, time.Now())
+	for i := 1; i <= 3; i++ {
+		e.track(&layers.TCP{Seq: 1000, Ack: 5000, ACK: true}, time.Now())
+		if e.dupAcks != i {
+			t.Fatal("duplicate acks:", e.dupAcks)
+		}
+	}
+
+	// data repeating the ack isn't a duplicate, but doesn't reset the count
+	e.track(&layers.TCP{Seq: 1000, Ack: 5000, ACK: true, PSH: true, BaseLayer: layers.BaseLayer{Payload: []byte("abc")}}, time.Now())
+	if e.dupAcks != 3 {
+		t.Fatal("duplicate acks after data:", e.dupAcks)
+	}
+
+	e.track(&layers.TCP{Seq: 1003, Ack: 5100, ACK: true}, time.Now())
+	if e.dupAcks != 0 {
+		t.Fatal("duplicate acks after the ack moved:", e.dupAcks)
+	}
+}
+
+func TestUnackedSegments(t *testing.T) {
+	e := tcpFlow{seq: 130, synced: true}
+	e.unacked = []segment{{seq: 100, data: make([]byte, 10)}, {seq: 110, data: make([]byte, 10)}, {seq: 120, data: make([]byte, 10)}}
+
+	// an ack in the middle of the second segment only releases the first
+	e.track(&layers.TCP{Ack: 115, ACK: true}, time.Now())
+	if len(e.unacked) != 2 || e.unacked[0].seq != 110 {
+		t.Fatal("unacked after partial ack:", e.unacked)
+	}
+	if e.seq != 130 {
+		t.Fatal("seq rewound by a stale ack:", e.seq)
+	}
+
+	e.track(&layers.TCP{Ack: 130, ACK: true}, time.Now())
+	if len(e.unacked) != 0 {
+		t.Fatal("unacked after full ack:", e.unacked)
+	}
+}
+
+func TestUniqueIPs(t *testing.T) {
+	// an alias listing the same address again, and an IPv4 address in both forms
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.1"), net.IPv4(10, 0, 0, 2).To4(), net.ParseIP("fe80::1")}
+	unique := uniqueIPs(ips)
+	if len(unique) != 3 {
+		t.Fatal("unexpected addresses:", unique)
+	}
+}
+
+func TestQueueWatermarks(t *testing.T) {
+	conn := &TCPConn{chMessage: make(chan message), die: make(chan struct{})}
+	defer close(conn.die)
+	if err := conn.SetQueueWatermarks(2, 1); err == nil {
+		t.Fatal("low above high accepted")
+	}
+	if err := conn.SetQueueWatermarks(1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		conn.deliver(message{bts: []byte{byte(i)}})
+	}
+	resumed := make(chan bool)
+	go func() { resumed <- conn.waitQueue() }()
+
+	// capture stays paused until the queue drains to the low watermark
+	for i := 0; i < 2; i++ {
+		select {
+		case <-resumed:
+			t.Fatal("resumed above the low watermark")
+		case msg := <-conn.chMessage:
+			if msg.bts[0] != byte(i) {
+				t.Fatal("out of order:", msg.bts[0])
+			}
+		}
+	}
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("not resumed at the low watermark")
+	}
+}
+
+func TestFlowQueueLimit(t *testing.T) {
+	conn := &TCPConn{die: make(chan struct{}), chMessage: make(chan message)}
+	defer close(conn.die)
+	if err := conn.SetFlowQueueLimit(2); err != nil {
+		t.Fatal(err)
+	}
+
+	// a busy peer fills its own queue only
+	a := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	b := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+	for i := 0; i < 5; i++ {
+		conn.deliver(message{addr: a})
+	}
+	conn.deliver(message{addr: b})
+
+	var order []string
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-conn.chMessage:
+			order = append(order, msg.addr.String())
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	if order[0] != a.String() || order[1] != b.String() || order[2] != a.String() {
+		t.Fatal("unexpected order:", order)
+	}
+	if stats, _ := conn.CaptureStats(); stats.Overflowed != 3 {
+		t.Fatal("overflowed:", stats.Overflowed)
+	}
+}
+
+func TestDynamicWindow(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	conn := &TCPConn{}
+	conn.SetMaxWindow(20000)
+	if w := conn.window(addr); w != 20000 {
+		t.Fatal("capped window:", w)
+	}
+
+	// half of the queue up to the high watermark is used
+	conn.SetDynamicWindow(true)
+	conn.queueHigh = 10
+	conn.queue = make([]message, 5)
+	if w := conn.window(addr); w != 10000 {
+		t.Fatal("window with half the queue used:", w)
+	}
+	conn.queue = make([]message, 20)
+	if w := conn.window(addr); w != 1250 {
+		t.Fatal("window with the queue full:", w)
+	}
+	conn.queue = nil
+	if w := conn.window(addr); w != 20000 {
+		t.Fatal("window with the queue drained:", w)
+	}
+}
+
+func TestFlowCreationRate(t *testing.T) {
+	conn := &TCPConn{flowTable: make(map[string]*tcpFlow)}
+	conn.SetFlowCreationRate(2)
+
+	ip := net.IPv4(10, 0, 0, 1)
+	for port := 1000; port < 1002; port++ {
+		src := &net.TCPAddr{IP: ip, Port: port}
+		if !conn.allowFlow(src) {
+			t.Fatal("flow within the rate dropped:", src)
+		}
+		conn.lockflow(src, func(e *tcpFlow) {})
+	}
+	if conn.allowFlow(&net.TCPAddr{IP: ip, Port: 1002}) {
+		t.Fatal("flow beyond the rate allowed")
+	}
+
+	// existing flows and other sources are unaffected
+	if !conn.allowFlow(&net.TCPAddr{IP: ip, Port: 1000}) {
+		t.Fatal("existing flow dropped")
+	}
+	if !conn.allowFlow(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}) {
+		t.Fatal("other source dropped")
+	}
+}
+
+func TestIPPayload(t *testing.T) {
+	// IPv4 handles pass the header on
+	packet := append([]byte{0x46, 8: 3, 23: 0}, "segment"...)
+	data, ttl := ipPayload(packet, nil, net.IPv4(10, 0, 0, 1))
+	if string(data) != "segment" || ttl != 3 {
+		t.Fatal("unexpected IPv4 payload:", data, ttl)
+	}
+
+	// IPv6 handles pass the hop limit in a control message
+	oob := make([]byte, syscall.CmsgSpace(4))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level, h.Type = syscall.IPPROTO_IPV6, syscall.IPV6_HOPLIMIT
+	h.SetLen(syscall.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = 7
+	data, ttl = ipPayload([]byte("segment"), oob, net.ParseIP("2001:db8::1"))
+	if string(data) != "segment" || ttl != 7 {
+		t.Fatal("unexpected IPv6 payload:", data, ttl)
+	}
+}
+
+func TestChecksumLayer(t *testing.T) {
+	ip4 := checksumLayer(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")).(*layers.IPv4)
+	if ip4.Protocol != layers.IPProtocolTCP {
+		t.Fatal("IPv4 protocol:", ip4.Protocol)
+	}
+	ip6 := checksumLayer(net.ParseIP("fe80::1"), net.ParseIP("fe80::2")).(*layers.IPv6)
+	if ip6.NextHeader != layers.IPProtocolTCP {
+		t.Fatal("IPv6 next header:", ip6.NextHeader)
+	}
+}
+
+func TestParseICMP(t *testing.T) {
+	// fragmentation needed, quoting a segment from 10.0.0.1:1000 to 10.0.0.2:2000
+	b := []byte{3, 4, 0, 0, 0, 0, 0x05, 0xdc}
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	ip[9] = 6
+	copy(ip[12:], net.IPv4(10, 0, 0, 1).To4())
+	copy(ip[16:], net.IPv4(10, 0, 0, 2).To4())
+	b = append(b, ip...)
+	b = append(b, 0x03, 0xe8, 0x07, 0xd0, 0, 0, 0, 0)
+
+	ev, ok := parseICMP(b, false)
+	if !ok {
+		t.Fatal("fragmentation needed not parsed")
+	}
+	if ev.Addr.String() != "10.0.0.2:2000" || ev.MTU != 1500 {
+		t.Fatal("unexpected event:", ev.Addr, ev.MTU)
+	}
+
+	// echo replies don't quote a segment
+	if _, ok := parseICMP([]byte{0, 0, 0, 0, 0, 0, 0, 0}, false); ok {
+		t.Fatal("echo reply parsed")
+	}
+}
+
+func TestRateMeter(t *testing.T) {
+	var m rateMeter
+	start := time.Unix(1000, 0)
+	for sec := 0; sec < 10; sec++ {
+		m.add(100, start.Add(time.Duration(sec)*time.Second))
+	}
+
+	// the current second is not complete yet
+	m.add(1000, start.Add(10*time.Second))
+	if r := m.rate(start.Add(10 * time.Second)); r != 100 {
+		t.Fatal("rate:", r)
+	}
+	if r := m.rate(start.Add(13 * time.Second)); r != 240 {
+		t.Fatal("rate:", r)
+	}
+	if r := m.rate(start.Add(time.Minute)); r != 0 {
+		t.Fatal("rate:", r)
+	}
+	if m.total != 2000 {
+		t.Fatal("total:", m.total)
+	}
+}
+
+func TestHandlesLocked(t *testing.T) {
+	handle, err := net.ListenIP("ip4:tcp", &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	conn := &TCPConn{server: true}
+
+	// handles are added under captureLock, e.g. by AddPeer, while the setters read them
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			conn.captureLock.Lock()
+			conn.handles = append(conn.handles, handle)
+			conn.captureLock.Unlock()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		conn.SetReadBuffer(1 << 16)
+		conn.SetDSCP(0)
+		conn.CaptureStats()
+		conn.handleFor(net.IPv4(127, 0, 0, 1))
+	}
+	<-done
+
+	handles := conn.Handles()
+	handles[0] = nil
+	if conn.Handles()[0] != handle {
+		t.Fatal("Handles shares its slice with the connection")
+	}
+}
+
+func TestAddPeer(t *testing.T) {
+	conn, err := Dial("tcp", testPortStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.AddPeer(portRemotePacket); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(conn.Handles()); n != 2 {
+		t.Fatal("handles:", n)
+	}
+
+	// both peers echo, through their own flow
+	buf := make([]byte, 1500)
+	for _, peer := range []string{testPortStream, portRemotePacket} {
+		addr, _ := net.ResolveTCPAddr("tcp", peer)
+		if _, err := conn.WriteTo([]byte("peer "+peer), addr); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "peer "+peer || from.String() != peer {
+			t.Fatalf("unexpected packet %q from %v", buf[:n], from)
+		}
+	}
+
+	ln, err := Listen("tcp", "127.0.0.1:3486")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if err := ln.AddPeer(testPortStream); err != errNotDialed {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func BenchmarkLockflow(b *testing.B) {
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3457}
+	for _, single := range []bool{false, true} {
+		name := "Map"
+		if single {
+			name = "Single"
+		}
+		b.Run(name, func(b *testing.B) {
+			conn := &TCPConn{flowTable: make(map[string]*tcpFlow)}
+			conn.lockflow(addr, func(e *tcpFlow) {
+				if single {
+					conn.single = e
+				}
+			})
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				conn.lockflow(&net.TCPAddr{IP: addr.IP, Port: addr.Port}, func(e *tcpFlow) { e.seq++ })
+			}
+		})
+	}
+}
+
+// the bpf syscall on linux/amd64, missing from package syscall
+const sysBPF = 321
+
+// loadSocketFilter loads an eBPF socket filter returning ret for every packet
+func loadSocketFilter(ret int32) (int, error) {
+	insns := []uint64{
+		0xb7 | uint64(uint32(ret))<<32, // mov64 r0, ret
+		0x95,                           // exit
+	}
+	license := []byte("GPL\x00")
+	attr := struct {
+		progType uint32
+		insnCnt  uint32
+		insns    uint64
+		license  uint64
+		pad      [96]byte
+	}{
+		progType: 1, // BPF_PROG_TYPE_SOCKET_FILTER
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	fd, _, errno := syscall.Syscall(sysBPF, 5, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr)) // BPF_PROG_LOAD
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// memHandle is an in-memory packetHandle, segments written to it are read from its peer
+type memHandle struct {
+	ip     net.IP
+	peer   *memHandle
+	in     chan []byte
+	die    chan struct{}
+	closer sync.Once
+	fail   int32 // writes left to fail with ENOBUFS
+}
+
+func memPipe(a, b net.IP) (*memHandle, *memHandle) {
+	ha := &memHandle{ip: a, in: make(chan []byte, 64), die: make(chan struct{})}
+	hb := &memHandle{ip: b, in: make(chan []byte, 64), die: make(chan struct{})}
+	ha.peer, hb.peer = hb, ha
+	return ha, hb
+}
+
+// ReadMsgIP passes an IPv4 header with TTL 64 in front of the segment, as the kernel does
+func (h *memHandle) ReadMsgIP(b, oob []byte) (n, oobn, flags int, addr *net.IPAddr, err error) {
+	select {
+	case p := <-h.in:
+		if h.peer.ip.To4() != nil {
+			header := make([]byte, 20)
+			header[0], header[8] = 0x45, 64
+			p = append(header, p...)
+		}
+		return copy(b, p), 0, 0, &net.IPAddr{IP: h.peer.ip}, nil
+	case <-h.die:
+		return 0, 0, 0, nil, ErrClosed
+	}
+}
+
+func (h *memHandle) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&h.fail) > 0 && atomic.AddInt32(&h.fail, -1) >= 0 {
+		return 0, syscall.ENOBUFS
+	}
+	p := make([]byte, len(b))
+	copy(p, b)
+	select {
+	case h.peer.in <- p:
+		return len(b), nil
+	case <-h.die:
+		return 0, ErrClosed
+	}
+}
+
+func (h *memHandle) WriteToIP(b []byte, addr *net.IPAddr) (int, error) { return h.Write(b) }
+
+func (h *memHandle) LocalAddr() net.Addr { return &net.IPAddr{IP: h.ip} }
+
+func (h *memHandle) Close() { h.closer.Do(func() { close(h.die) }) }
+
+// memConn builds a raw-only connection capturing on h, without any socket
+func memConn(server bool, laddr, raddr *net.TCPAddr, h *memHandle) *TCPConn {
+	conn := &TCPConn{
+		die:       make(chan struct{}),
+		flowTable: make(map[string]*tcpFlow),
+		chMessage: make(chan message),
+		flags:     uint32(defaultFlags),
+		wscale:    defaultWindowScale,
+		opts:      gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		rawOnly:   true,
+		server:    server,
+		laddr:     laddr,
+		raddr:     raddr,
+	}
+	conn.writeSem.Store(make(chan struct{}, defaultWriteConcurrency))
+	conn.captureWorkers = 1
+	conn.readers.Add(1)
+	go conn.captureFlow(h, laddr.Port, 0)
+	return conn
+}
+
+// newMemFlow builds a client connection on an in-memory pipe, with a ready flow of
+// sequence number 1000 to the server address on port, and returns the server's end
+// and a func closing both ends
+func newMemFlow(port int) (*TCPConn, *memHandle, *net.TCPAddr, func()) {
+	caddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	saddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: port}
+	ch, sh := memPipe(caddr.IP, saddr.IP)
+	conn := memConn(false, caddr, saddr, ch)
+	readyFlow(conn, saddr, ch)
+	return conn, sh, saddr, func() {
+		conn.Close()
+		ch.Close()
+		sh.Close()
+	}
+}
+
+// readyFlow makes the flow to addr ready on h, with sequence number 1000
+func readyFlow(conn *TCPConn, addr net.Addr, h *memHandle) {
+	conn.lockflow(addr, func(e *tcpFlow) {
+		e.handle = h
+		e.raw = true
+		e.ready = true
+		e.seq = 1000
+	})
+}
+
+// recvBytes returns the next segment written to h, and fails the test if none is
+// within a second
+func recvBytes(t *testing.T, h *memHandle) []byte {
+	t.Helper()
+	select {
+	case p := <-h.in:
+		return p
+	case <-time.After(time.Second):
+		t.Fatal("no segment written")
+		return nil
+	}
+}
+
+// recvSegment acts like recvBytes, with the segment decoded
+func recvSegment(t *testing.T, h *memHandle) *layers.TCP {
+	t.Helper()
+	return gopacket.NewPacket(recvBytes(t, h), layers.LayerTypeTCP, gopacket.Default).TransportLayer().(*layers.TCP)
+}
+
+// sendSegment writes a segment of the peer carrying payload to h, as if captured
+func sendSegment(h *memHandle, tcp *layers.TCP, payload []byte) {
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, tcp, gopacket.Payload(payload))
+	h.Write(buf.Bytes())
+}
+
+func TestMemRoundTrip(t *testing.T) {
+	caddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	saddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 3461}
+	ch, sh := memPipe(caddr.IP, saddr.IP)
+	defer ch.Close()
+	defer sh.Close()
+	client := memConn(false, caddr, saddr, ch)
+	defer client.Close()
+	server := memConn(true, saddr, nil, sh)
+	defer server.Close()
+
+	// the crafted handshake is answered by the raw-only server
+	probe := make(chan struct{})
+	client.lockflow(saddr, func(e *tcpFlow) { e.probe = probe })
+	if err := client.sendSYN(saddr, ch); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-probe:
+	case <-time.After(time.Second):
+		t.Fatal("handshake timeout")
+	}
+
+	buf := make([]byte, 1500)
+	for i, pair := range []struct{ from, to *TCPConn }{{client, server}, {server, client}, {client, server}} {
+		var src, dst net.Addr = caddr, saddr
+		if pair.from == server {
+			src, dst = saddr, caddr
+		}
+		msg := []byte("round trip " + string(rune('a'+i)))
+		if _, err := pair.from.WriteTo(msg, dst); err != nil {
+			t.Fatal(err)
+		}
+		pair.to.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, meta, err := pair.to.ReadFromMeta(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.TTL != 64 {
+			t.Fatal("TTL:", meta.TTL)
+		}
+		if string(buf[:n]) != string(msg) || addr.String() != src.String() {
+			t.Fatal("unexpected read:", string(buf[:n]), addr)
+		}
+	}
+
+	// both sides agree on the sequence space
+	var cseq, cack, sseq, sack uint32
+	client.lockflow(saddr, func(e *tcpFlow) { cseq, cack = e.seq, e.ack })
+	server.lockflow(caddr, func(e *tcpFlow) { sseq, sack = e.seq, e.ack })
+	if cseq != sack || sseq != cack {
+		t.Fatal("sequence mismatch:", cseq, sack, sseq, cack)
+	}
+
+	// a FIN tears the flow down on the server
+	closed := make(chan string, 1)
+	server.SetOnFlowClosed(func(addr net.Addr, reason string) { closed <- reason })
+	if _, err := client.WriteToWithFlags(nil, saddr, FlagFIN|FlagACK); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case reason := <-closed:
+		if reason != "fin" {
+			t.Fatal("flow closed by", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("flow not closed by FIN")
+	}
+}
+
+func TestEmptyWrite(t *testing.T) {
+	conn, sh, saddr, closeFlow := newMemFlow(3464)
+	defer closeFlow()
+
+	if _, err := conn.WriteTo(nil, saddr); err != nil {
+		t.Fatal(err)
+	}
+	tcp := recvSegment(t, sh)
+	if tcp.PSH || !tcp.ACK || len(tcp.Payload) != 0 {
+		t.Fatal("unexpected flags:", getFlags(tcp))
+	}
+	var seq uint32
+	conn.lockflow(saddr, func(e *tcpFlow) { seq = e.seq })
+	if seq != 1000 {
+		t.Fatal("seq advanced by an empty write:", seq)
+	}
+}
+
+func TestMaxWriteSize(t *testing.T) {
+	conn, sh, saddr, closeFlow := newMemFlow(3472)
+	defer closeFlow()
+
+	conn.SetMaxWriteSize(4)
+	if _, err := conn.WriteTo([]byte("hello"), saddr); err != errWriteSize {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := conn.WriteToSeq([]byte("hello"), saddr, 1); err != errWriteSize {
+		t.Fatal("unexpected error:", err)
+	}
+	if n, err := conn.WriteTo([]byte("hell"), saddr); err != nil || n != 4 {
+		t.Fatal(n, err)
+	}
+	tcp := recvSegment(t, sh)
+	if string(tcp.Payload) != "hell" {
+		t.Fatalf("unexpected payload: %q", tcp.Payload)
+	}
+
+	// an empty write is still a pure ACK, and 0 removes the limit
+	if _, err := conn.WriteTo(nil, saddr); err != nil {
+		t.Fatal(err)
+	}
+	recvSegment(t, sh)
+	conn.SetMaxWriteSize(0)
+	if _, err := conn.WriteTo([]byte("hello"), saddr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckRoute(t *testing.T) {
+	var buf bytes.Buffer
+	conn := &TCPConn{server: true, logger: log.New(&buf, "", 0)}
+
+	// replies to a local peer leave through lo, which lacks the address
+	conn.checkRoute(&memHandle{ip: net.IPv4(192, 0, 2, 1)}, net.IPv4(127, 0, 0, 1))
+	if !strings.Contains(buf.String(), "routed through an interface without 192.0.2.1") {
+		t.Fatalf("no warning: %q", buf.String())
+	}
+	buf.Reset()
+	conn.checkRoute(&memHandle{ip: net.IPv4(127, 0, 0, 1)}, net.IPv4(127, 0, 0, 1))
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected warning: %q", buf.String())
+	}
+}
+
+func TestSetPorts(t *testing.T) {
+	conn, sh, saddr, closeFlow := newMemFlow(3474)
+	defer closeFlow()
+
+	if err := conn.SetPorts(65536, 0); err != errPort {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := conn.SetPorts(1111, 0); err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteTo([]byte("abc"), saddr)
+	tcp := recvSegment(t, sh)
+	if tcp.SrcPort != 1111 || tcp.DstPort != 3474 {
+		t.Fatal("unexpected ports:", tcp.SrcPort, tcp.DstPort)
+	}
+	conn.SetPorts(0, 2222)
+	conn.WriteTo([]byte("abc"), saddr)
+	tcp = recvSegment(t, sh)
+	if tcp.SrcPort != 40000 || tcp.DstPort != 2222 {
+		t.Fatal("unexpected ports:", tcp.SrcPort, tcp.DstPort)
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	client, sh, saddr, closeFlow := newMemFlow(3475)
+	defer closeFlow()
+	caddr := client.laddr
+	server := memConn(true, saddr, nil, sh)
+	defer server.Close()
+	server.lockflow(caddr, func(e *tcpFlow) { e.raw = true })
+
+	if _, err := client.WriteTo([]byte("hello"), saddr); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := server.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if tp := client.Throughput(); tp.Sent != 5 || tp.Received != 0 {
+		t.Fatal("client:", tp)
+	}
+	if tp := server.FlowThroughput(caddr); tp.Sent != 0 || tp.Received != 5 {
+		t.Fatal("server flow:", tp)
+	}
+	if tp := server.FlowThroughput(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 1}); tp != (Throughput{}) {
+		t.Fatal("unknown flow:", tp)
+	}
+}
+
+func TestWriteRetries(t *testing.T) {
+	conn, sh, saddr, closeFlow := newMemFlow(3477)
+	defer closeFlow()
+	conn.SetWriteRetries(2, 100*time.Millisecond)
+	atomic.StoreInt32(&sh.peer.fail, 2)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.WriteTo([]byte("retried"), saddr)
+		done <- err
+	}()
+
+	// the backoff doesn't hold the flow table
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	conn.lockflow(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 1}, func(e *tcpFlow) {})
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatal("flow table locked for", d)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if tcp := recvSegment(t, sh); tcp.Seq != 1000 || string(tcp.Payload) != "retried" {
+		t.Fatal("unexpected segment:", tcp.Seq, string(tcp.Payload))
+	}
+	var seq uint32
+	conn.lockflow(saddr, func(e *tcpFlow) { seq = e.seq })
+	if seq != 1007 {
+		t.Fatal("seq after the retried write:", seq)
+	}
+
+	// a write failing for good leaves the sequence number
+	conn.SetWriteRetries(0, 0)
+	atomic.StoreInt32(&sh.peer.fail, 1)
+	if _, err := conn.WriteTo([]byte("lost"), saddr); err != syscall.ENOBUFS {
+		t.Fatal("unexpected error:", err)
+	}
+	conn.lockflow(saddr, func(e *tcpFlow) { seq = e.seq })
+	if seq != 1007 {
+		t.Fatal("seq after a failed write:", seq)
+	}
+
+	// Close doesn't wait for the backoff
+	conn.SetWriteRetries(3, time.Second)
+	atomic.StoreInt32(&sh.peer.fail, 4)
+	go func() {
+		_, err := conn.WriteTo([]byte("closed"), saddr)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	start = time.Now()
+	conn.Close()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatal("Close blocked for", d)
+	}
+	if err := <-done; err != ErrClosed {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	conn, sh, saddr, closeFlow := newMemFlow(3480)
+	defer closeFlow()
+	conn.SetNoDelay(false)
+
+	// sent at once when reaching coalesceSize
+	for i := 0; i < 3; i++ {
+		if _, err := conn.WriteTo(bytes.Repeat([]byte{byte('a' + i)}, 500), saddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tcp := recvSegment(t, sh); tcp.Seq != 1000 || len(tcp.Payload) != 1500 {
+		t.Fatal("unexpected segment:", tcp.Seq, len(tcp.Payload))
+	}
+
+	// sent after coalesceDelay
+	if _, err := conn.WriteTo([]byte("tick"), saddr); err != nil {
+		t.Fatal(err)
+	}
+	if len(sh.in) != 0 {
+		t.Fatal("sent before the delay")
+	}
+	if tcp := recvSegment(t, sh); string(tcp.Payload) != "tick" {
+		t.Fatal("unexpected payload:", string(tcp.Payload))
+	}
+
+	// sent by Flush
+	conn.WriteTo([]byte("fl"), saddr)
+	conn.WriteTo([]byte("ush"), saddr)
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if tcp := recvSegment(t, sh); tcp.Seq != 2504 || string(tcp.Payload) != "flush" {
+		t.Fatal("unexpected segment:", tcp.Seq, string(tcp.Payload))
+	}
+
+	// a failed delayed flush is reported by the next write, then by Flush
+	for _, next := range []func() error{
+		func() error { _, err := conn.WriteTo([]byte("next"), saddr); return err },
+		conn.Flush,
+	} {
+		atomic.StoreInt32(&sh.peer.fail, 1)
+		conn.WriteTo([]byte("lost"), saddr)
+		time.Sleep(5 * coalesceDelay)
+		if err := next(); err != syscall.ENOBUFS {
+			t.Fatal("unexpected error:", err)
+		}
+		if err := conn.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWriteToContext(t *testing.T) {
+	conn, sh, saddr, closeFlow := newMemFlow(3479)
+	defer closeFlow()
+	ctx := context.Background()
+
+	// an empty payload is a pure ack, like WriteTo
+	if _, err := conn.WriteToContext(ctx, nil, saddr); err != nil {
+		t.Fatal(err)
+	}
+	if tcp := recvSegment(t, sh); tcp.PSH || !tcp.ACK || tcp.Seq != 1000 {
+		t.Fatal("unexpected segment:", getFlags(tcp), tcp.Seq)
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := conn.WriteToContext(ctx, []byte("late"), saddr); err != errTimeout {
+		t.Fatal("unexpected error:", err)
+	}
+	conn.SetWriteDeadline(time.Time{})
+
+	// coalesced until flushed
+	conn.SetNoDelay(false)
+	if _, err := conn.WriteToContext(ctx, []byte("ab"), saddr); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if tcp := recvSegment(t, sh); string(tcp.Payload) != "ab" {
+		t.Fatal("unexpected payload:", string(tcp.Payload))
+	}
+	conn.SetNoDelay(true)
+
+	// cancelled while waiting for pacing
+	conn.SetPacing(10)
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := conn.WriteToContext(timeout, make([]byte, 100), saddr); err != context.DeadlineExceeded {
+		t.Fatal("unexpected error:", err)
+	}
+	conn.SetPacing(0)
+	if _, err := conn.WriteToContext(ctx, []byte("c"), saddr); err != nil {
+		t.Fatal(err)
+	}
+	if tcp := recvSegment(t, sh); tcp.Seq != 1002 || string(tcp.Payload) != "c" {
+		t.Fatal("unexpected segment:", tcp.Seq, string(tcp.Payload))
+	}
+}
+
+func TestReadFromContext(t *testing.T) {
+	conn, sh, saddr, closeFlow := newMemFlow(3488)
+	defer closeFlow()
+	ctx := context.Background()
+	buf := make([]byte, 1500)
+
+	conn.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, _, err := conn.ReadFromContext(ctx, buf); err != errTimeout {
+		t.Fatal("unexpected error:", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := conn.ReadFromContext(timeout, buf); err != context.DeadlineExceeded {
+		t.Fatal("unexpected error:", err)
+	}
+
+	sendSegment(sh, &layers.TCP{SrcPort: 3488, DstPort: 40000, Seq: 5000, Ack: 1000, ACK: true, PSH: true}, []byte("hello"))
+	n, addr, err := conn.ReadFromContext(ctx, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" || addr.String() != saddr.String() {
+		t.Fatal("unexpected read:", string(buf[:n]), addr)
+	}
+}
+
+func TestExportImportFlows(t *testing.T) {
+	conn, sh, saddr, closeFlow := newMemFlow(3481)
+	defer closeFlow()
+	caddr := conn.LocalAddr().(*net.TCPAddr)
+	sendSegment(sh, &layers.TCP{SrcPort: 3481, DstPort: 40000, Seq: 5000, Ack: 1000, ACK: true, PSH: true}, []byte("abc"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadFrom(make([]byte, 1500)); err != nil {
+		t.Fatal(err)
+	}
+	conn.lockflow(saddr, func(e *tcpFlow) { e.peerScale = 7 })
+	if _, err := conn.WriteTo([]byte("x"), saddr); err != nil {
+		t.Fatal(err)
+	}
+	recvSegment(t, sh)
+
+	flows, err := conn.ExportFlows()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the fresh connection resumes the flow on the handle routing to the peer,
+	// which is then swapped for another pipe
+	handle, err := net.DialIP("ip4:tcp", nil, &net.IPAddr{IP: saddr.IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	ch, sh2 := memPipe(caddr.IP, saddr.IP)
+	defer ch.Close()
+	defer sh2.Close()
+	fresh := memConn(false, caddr, saddr, ch)
+	defer fresh.Close()
+	fresh.handles = []*net.IPConn{handle}
+	if err := fresh.ImportFlows(flows); err != nil {
+		t.Fatal(err)
+	}
+	var imported bool
+	var peerScale uint8
+	fresh.lockflow(saddr, func(e *tcpFlow) {
+		imported = e.ready && e.handle == handle
+		peerScale = e.peerScale
+		e.handle = ch
+	})
+	if !imported || peerScale != 7 {
+		t.Fatal("flow not imported:", imported, peerScale)
+	}
+
+	if _, err := fresh.WriteTo([]byte("y"), saddr); err != nil {
+		t.Fatal(err)
+	}
+	if tcp := recvSegment(t, sh2); tcp.Seq != 1001 || tcp.Ack != 5003 || string(tcp.Payload) != "y" {
+		t.Fatal("unexpected segment:", tcp.Seq, tcp.Ack, string(tcp.Payload))
+	}
+}
+
+func TestPacing(t *testing.T) {
+	conn, sh, saddr, closeFlow := newMemFlow(3482)
+	defer closeFlow()
+
+	// the bucket starts empty, each 100 bytes wait 100ms at 1000 bytes per second
+	conn.SetPacing(1000)
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, err := conn.WriteTo(make([]byte, 100), saddr); err != nil {
+			t.Fatal(err)
+		}
+		recvSegment(t, sh)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatal("paced writes took", d)
+	}
+
+	conn.SetPacing(0)
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		if _, err := conn.WriteTo(make([]byte, 100), saddr); err != nil {
+			t.Fatal(err)
+		}
+		recvSegment(t, sh)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatal("unpaced writes took", d)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	conn, sh, saddr, closeFlow := newMemFlow(3483)
+	defer closeFlow()
+
+	// the probe is one byte behind, and times out without an answer
+	if err := conn.Probe(saddr, 50*time.Millisecond); err != errTimeout {
+		t.Fatal("unexpected error:", err)
+	}
+	if tcp := recvSegment(t, sh); !tcp.ACK || tcp.PSH || tcp.Seq != 999 || len(tcp.Payload) != 0 {
+		t.Fatal("unexpected probe:", getFlags(tcp), tcp.Seq)
+	}
+	var seq uint32
+	conn.lockflow(saddr, func(e *tcpFlow) { seq = e.seq })
+	if seq != 1000 {
+		t.Fatal("seq changed by the probe:", seq)
+	}
+
+	// any packet of the peer answers it
+	done := make(chan error, 1)
+	go func() { done <- conn.Probe(saddr, time.Second) }()
+	recvSegment(t, sh)
+	sendSegment(sh, &layers.TCP{SrcPort: 3483, DstPort: 40000, Seq: 5000, Ack: 1000, ACK: true}, nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.Probe(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 1}, time.Second); err != errNoHandle {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestQueueUntilReady(t *testing.T) {
+	caddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	saddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 3484}
+	ch, sh := memPipe(caddr.IP, saddr.IP)
+	defer ch.Close()
+	defer sh.Close()
+	client := memConn(false, caddr, saddr, ch)
+	defer client.Close()
+	server := memConn(true, saddr, nil, sh)
+	defer server.Close()
+	readyFlow(server, caddr, sh)
+
+	// the raw flow has no handle until the server's first packet
+	client.lockflow(saddr, func(e *tcpFlow) { e.raw = true })
+	if _, err := client.WriteTo([]byte("dropped"), saddr); err != nil {
+		t.Fatal(err)
+	}
+	client.SetQueueUntilReady(true)
+	if n, err := client.WriteTo([]byte("queued"), saddr); err != nil || n != 6 {
+		t.Fatal(n, err)
+	}
+
+	if _, err := server.WriteTo([]byte("hello"), caddr); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := client.ReadFrom(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("client read %q: %v", buf[:n], err)
+	}
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := server.ReadFrom(buf); err != nil || string(buf[:n]) != "queued" {
+		t.Fatalf("server read %q: %v", buf[:n], err)
+	}
+
+	// the queue of a flow is bounded, and discarded when turned off
+	other := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 1}
+	for i := 0; i < maxQueued; i++ {
+		client.WriteTo([]byte("x"), other)
+	}
+	if _, err := client.WriteTo([]byte("x"), other); err != errQueueFull {
+		t.Fatal("unexpected error:", err)
+	}
+	client.SetQueueUntilReady(false)
+	var queued int
+	client.lockflow(other, func(e *tcpFlow) { queued = len(e.queued) })
+	if queued != 0 {
+		t.Fatal("queued after turning it off:", queued)
+	}
+}
+
+func TestDrainRead(t *testing.T) {
+	conn, sh, saddr, closeFlow := newMemFlow(3485)
+	defer closeFlow()
+	conn.SetQueueWatermarks(8, 4)
+	if n := conn.DrainRead(func([]byte, net.Addr) { t.Error("drained a packet") }); n != 0 {
+		t.Fatal("drained", n)
+	}
+
+	seq := uint32(5000)
+	for _, p := range []string{"one", "two", "three"} {
+		sendSegment(sh, &layers.TCP{SrcPort: 3485, DstPort: 40000, Seq: seq, Ack: 1000, ACK: true, PSH: true}, []byte(p))
+		seq += uint32(len(p))
+	}
+
+	// without blocking, in the order captured
+	var drained []string
+	deadline := time.Now().Add(time.Second)
+	for len(drained) < 3 && time.Now().Before(deadline) {
+		conn.DrainRead(func(p []byte, addr net.Addr) {
+			if addr.String() != saddr.String() {
+				t.Error("drained from", addr)
+			}
+			drained = append(drained, string(p))
+		})
+		time.Sleep(time.Millisecond)
+	}
+	if strings.Join(drained, " ") != "one two three" {
+		t.Fatal("drained:", drained)
+	}
+}
+
+func TestDelayedAck(t *testing.T) {
+	conn, sh, saddr, closeFlow := newMemFlow(3487)
+	defer closeFlow()
+	buf := make([]byte, 1500)
+	seq := uint32(5000)
+	recv := func(p string) {
+		t.Helper()
+		sendSegment(sh, &layers.TCP{SrcPort: 3487, DstPort: 40000, Seq: seq, Ack: 1000, ACK: true, PSH: true}, []byte(p))
+		seq += uint32(len(p))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := conn.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// acked on the count
+	conn.SetDelayedAck(2, 0)
+	recv("a")
+	if len(sh.in) != 0 {
+		t.Fatal("acked before the count")
+	}
+	recv("b")
+	if tcp := recvSegment(t, sh); len(tcp.Payload) != 0 || tcp.Ack != 5002 {
+		t.Fatal("unexpected ack:", tcp.Ack, len(tcp.Payload))
+	}
+
+	// acked after the timeout
+	conn.SetDelayedAck(2, 20*time.Millisecond)
+	recv("c")
+	if tcp := recvSegment(t, sh); len(tcp.Payload) != 0 || tcp.Ack != 5003 {
+		t.Fatal("unexpected ack:", tcp.Ack, len(tcp.Payload))
+	}
+
+	// data sent meanwhile carries the ack
+	recv("d")
+	if _, err := conn.WriteTo([]byte("x"), saddr); err != nil {
+		t.Fatal(err)
+	}
+	if tcp := recvSegment(t, sh); string(tcp.Payload) != "x" || tcp.Ack != 5004 {
+		t.Fatal("unexpected segment:", tcp.Ack, string(tcp.Payload))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(sh.in) != 0 {
+		t.Fatal("acked again after the data")
+	}
+}
+
+func TestWriteToSeq(t *testing.T) {
+	conn, sh, saddr, closeFlow := newMemFlow(3467)
+	defer closeFlow()
+
+	if _, err := conn.WriteToSeq([]byte("again"), saddr, 900); err != nil {
+		t.Fatal(err)
+	}
+	tcp := recvSegment(t, sh)
+	if tcp.Seq != 900 || string(tcp.Payload) != "again" {
+		t.Fatal("unexpected segment:", tcp.Seq, string(tcp.Payload))
+	}
+	var seq uint32
+	conn.lockflow(saddr, func(e *tcpFlow) { seq = e.seq })
+	if seq != 1000 {
+		t.Fatal("seq changed:", seq)
+	}
+}
+
+func TestSendRST(t *testing.T) {
+	conn, sh, saddr, closeFlow := newMemFlow(3465)
+	defer closeFlow()
+
+	closed := make(chan string, 1)
+	conn.SetOnFlowClosed(func(addr net.Addr, reason string) { closed <- reason })
+	if err := conn.SendRST(saddr); err != nil {
+		t.Fatal(err)
+	}
+	tcp := recvSegment(t, sh)
+	if !tcp.RST || tcp.Seq != 1000 {
+		t.Fatal("unexpected segment:", getFlags(tcp), tcp.Seq)
+	}
+	if reason := <-closed; reason != "rst" {
+		t.Fatal("flow closed by", reason)
+	}
+
+	// the flow is gone
+	if err := conn.SendRST(saddr); err != errNoHandle {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestOSProfile(t *testing.T) {
+	conn, sh, saddr, closeFlow := newMemFlow(3466)
+	defer closeFlow()
+	if err := conn.SetOSProfile("beos"); err != errOSProfile {
+		t.Fatal("unexpected error:", err)
+	}
+
+	kinds := func(tcp *layers.TCP) (k []layers.TCPOptionKind) {
+		for _, opt := range tcp.Options {
+			k = append(k, opt.OptionType)
+		}
+		return
+	}
+	next := func() *layers.TCP { return recvSegment(t, sh) }
+
+	for _, profile := range []OSProfile{OSProfileLinux, OSProfileWindows10} {
+		if err := conn.SetOSProfile(profile); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.sendSYN(saddr, sh.peer); err != nil {
+			t.Fatal(err)
+		}
+		syn := next()
+		if fmt.Sprint(kinds(syn)) != fmt.Sprint(osProfiles[profile].synOptions) || syn.Window != 64240 {
+			t.Fatal(profile, "SYN options:", kinds(syn), "window:", syn.Window)
+		}
+	}
+
+	// timestamps echo the peer's once it sends them
+	conn.SetOSProfile(OSProfileLinux)
+	conn.lockflow(saddr, func(e *tcpFlow) {
+		e.ready = true
+		e.trackTimestamp(&layers.TCP{Options: []layers.TCPOption{{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: []byte{0, 0, 0, 1, 0, 0, 0, 0}}}})
+	})
+	if _, err := conn.WriteTo([]byte("data"), saddr); err != nil {
+		t.Fatal(err)
+	}
+	data := next()
+	if len(data.Options) != 3 || data.Options[2].OptionType != layers.TCPOptionKindTimestamps || data.Options[2].OptionData[7] != 1 {
+		t.Fatal("data options:", data.Options)
+	}
+
+	// back to the defaults
+	conn.SetOSProfile(OSProfileNone)
+	if _, err := conn.WriteTo([]byte("data"), saddr); err != nil {
+		t.Fatal(err)
+	}
+	if data := next(); len(data.Options) != 0 {
+		t.Fatal("options without a profile:", data.Options)
+	}
+}
+
+func TestMultiHandleDedupe(t *testing.T) {
+	client, sh, saddr, closeFlow := newMemFlow(3468)
+	defer closeFlow()
+	caddr, ch := client.laddr, sh.peer
+
+	// the server captures the same traffic on a second handle
+	mirror := &memHandle{ip: saddr.IP, peer: ch, in: make(chan []byte, 64), die: make(chan struct{})}
+	defer mirror.Close()
+	server := &TCPConn{die: make(chan struct{}), flowTable: make(map[string]*tcpFlow), chMessage: make(chan message), laddr: saddr, server: true, captureWorkers: 1}
+	defer server.Close()
+	server.lockflow(caddr, func(e *tcpFlow) { e.raw = true })
+
+	for _, msg := range []string{"first", "second"} {
+		if _, err := client.WriteTo([]byte(msg), saddr); err != nil {
+			t.Fatal(err)
+		}
+		segment := recvBytes(t, sh)
+		sh.in <- segment
+		mirror.in <- segment
+	}
+	server.readers.Add(2)
+	go server.captureFlow(sh, saddr.Port, 0)
+	go server.captureFlow(mirror, saddr.Port, 0)
+
+	// the handles are captured concurrently, in any order
+	buf := make([]byte, 1500)
+	read := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read[string(buf[:n])] = true
+	}
+	if !read["first"] || !read["second"] {
+		t.Fatal("unexpected reads:", read)
+	}
+	server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := server.ReadFrom(buf); err == nil {
+		t.Fatal("duplicate delivered:", string(buf[:n]))
+	}
+}
+
+func TestReadFromPacket(t *testing.T) {
+	client, sh, saddr, closeFlow := newMemFlow(3469)
+	defer closeFlow()
+	server := memConn(true, saddr, nil, sh)
+	defer server.Close()
+	server.lockflow(client.laddr, func(e *tcpFlow) { e.raw = true })
+
+	buf := make([]byte, 1500)
+	for _, keep := range []bool{false, true} {
+		server.SetKeepPackets(keep)
+		if _, err := client.WriteTo([]byte("packet"), saddr); err != nil {
+			t.Fatal(err)
+		}
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, pkt, err := server.ReadFromPacket(buf)
+		if err != nil || string(buf[:n]) != "packet" {
+			t.Fatal("unexpected read:", string(buf[:n]), err)
+		}
+		if !keep {
+			if pkt != nil {
+				t.Fatal("packet kept")
+			}
+			continue
+		}
+		tcp, ok := pkt.TransportLayer().(*layers.TCP)
+		if !ok || int(tcp.DstPort) != saddr.Port || string(tcp.Payload) != "packet" {
+			t.Fatal("unexpected packet:", pkt)
+		}
+	}
+}
+
+func TestNoSelfCapture(t *testing.T) {
+	// a loopback handle captures what it sends, including segments to our own port
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3463}
+	h := &memHandle{ip: addr.IP, in: make(chan []byte, 64), die: make(chan struct{})}
+	h.peer = h
+	defer h.Close()
+	conn := memConn(false, addr, addr, h)
+	defer conn.Close()
+	readyFlow(conn, addr, h)
+
+	if _, err := conn.WriteTo([]byte("echo"), addr); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := conn.ReadFrom(make([]byte, 1500)); err == nil {
+		t.Fatal("own segment delivered:", n)
+	}
+}
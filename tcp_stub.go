@@ -15,6 +15,16 @@ func Dial(network, address string) (*TCPConn, error) {
 	return nil, errors.New("os not supported")
 }
 
+// Dial acts like the package-level Dial, with the options in d applied.
+func (d *Dialer) Dial(network, address string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
 func Listen(network, address string) (*TCPConn, error) {
 	return nil, errors.New("os not supported")
 }
+
+// Listen acts like the package-level Listen, with the options in lc applied.
+func (lc *ListenConfig) Listen(network, address string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
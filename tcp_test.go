@@ -1,11 +1,15 @@
 package tcpraw
 
 import (
+	"io"
 	"log"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os/exec"
+	"sync"
 	"testing"
+	"time"
 )
 
 //const testPortStream = "127.0.0.1:3456"
@@ -14,6 +18,7 @@ import (
 const testPortStream = "127.0.0.1:3456"
 const portServerPacket = "[::]:3457"
 const portRemotePacket = "127.0.0.1:3457"
+const portRemotePacket6 = "[::1]:3457"
 
 func init() {
 	startTCPServer()
@@ -148,20 +153,165 @@ func TestDialToTCPPacket(t *testing.T) {
 	log.Println("complete")
 }
 
-func TestSettings(t *testing.T) {
-	conn, err := Dial("tcp", portRemotePacket)
+func TestDialToTCPPacket6(t *testing.T) {
+	conn, err := Dial("tcp", portRemotePacket6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	addr, err := net.ResolveTCPAddr("tcp", portRemotePacket6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := conn.WriteTo([]byte("abc"), addr)
+	if err != nil {
+		t.Fatal(n, err)
+	}
+
+	buf := make([]byte, 1024)
+	if n, addr, err := conn.ReadFrom(buf); err != nil {
+		t.Fatal(n, addr, err)
+	} else {
+		log.Println(string(buf[:n]), "from:", addr)
+	}
+}
+
+func TestDialFamily(t *testing.T) {
+	conn4, err := Dial("tcp4", portRemotePacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn4.Close()
+	if conn4.LocalAddr().(*net.TCPAddr).IP.To4() == nil {
+		t.Fatal("tcp4 dialed from", conn4.LocalAddr())
+	}
+
+	conn6, err := Dial("tcp6", portRemotePacket6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn6.Close()
+	if conn6.LocalAddr().(*net.TCPAddr).IP.To4() != nil {
+		t.Fatal("tcp6 dialed from", conn6.LocalAddr())
+	}
+
+	if conn, err := Dial("tcp6", portRemotePacket); err == nil {
+		conn.Close()
+		t.Fatal("tcp6 dialed an IPv4 address")
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	lc := ListenConfig{ReusePort: true}
+	ln1, err := lc.Listen("tcp", "127.0.0.1:3459")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln1.Close()
+	ln2, err := lc.Listen("tcp", "127.0.0.1:3459")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln2.Close()
+}
+
+func TestListenMaxAccepted(t *testing.T) {
+	// KeepTTL lets the FIN of the refused connection reach the peer
+	lc := ListenConfig{KeepTTL: true, Backlog: 16, MaxAccepted: 1}
+	ln, err := lc.Listen("tcp", "127.0.0.1:3462")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var refused int
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", "127.0.0.1:3462")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		if _, err := c.Read(make([]byte, 1)); err == io.EOF {
+			refused++
+		}
+	}
+	if refused != 1 {
+		t.Fatal("refused connections:", refused)
+	}
+}
+
+func TestRawOnly(t *testing.T) {
+	// the kernel resets the crafted handshakes unless iptables drops them
+	if _, err := exec.LookPath("iptables"); err != nil {
+		t.Skip("iptables not available")
+	}
+
+	lc := ListenConfig{RawOnly: true}
+	ln, err := lc.Listen("tcp", "127.0.0.1:3460")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	d := Dialer{RawOnly: true}
+	conn, err := d.Dial("tcp", "127.0.0.1:3460")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer conn.Close()
-	if err := conn.SetDSCP(46); err != nil {
-		log.Fatal("SetDSCP:", err)
+
+	if _, err := conn.WriteTo([]byte("hello"), &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3460}); err != nil {
+		t.Fatal(err)
+	}
+	ln.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, addr, err := ln.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if err := conn.SetReadBuffer(4096); err != nil {
-		log.Fatal("SetReaderBuffer:", err)
+	if string(buf[:n]) != "hello" || addr.String() != conn.LocalAddr().String() {
+		t.Fatal("unexpected packet:", string(buf[:n]), addr)
 	}
-	if err := conn.SetWriteBuffer(4096); err != nil {
-		log.Fatal("SetWriteBuffer:", err)
+}
+
+func TestCloseWhileWriting(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		conn, err := Dial("tcp", portRemotePacket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := net.ResolveTCPAddr("tcp", portRemotePacket)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					if _, err := conn.WriteTo([]byte("abc"), addr); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		conn.Close()
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != ErrClosed {
+				t.Fatal("WriteTo after Close:", err)
+			}
+		}
 	}
 }
 